@@ -1,32 +1,104 @@
 package api
 
 import (
-	"crypto/subtle"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/moderation"
 )
 
 type API struct {
 	router *mux.Router
 	mdb    *db.MessageDB
+	users  *UserStore
+	auth   []Authenticator
+
+	idempotency    *idempotencyCache
+	limiter        *rateLimiter
+	trustedProxies []*net.IPNet
+	maxStoredBytes int64
+	bodyLimit      int64
+	bodyLimits     map[string]int64 //by path template
+	moderation     *moderation.Pipeline
 }
 
-func InitAPI(db *db.MessageDB) (*API, error) {
+func InitAPI(db *db.MessageDB, users *UserStore) (*API, error) {
+	if users == nil {
+		return nil, errors.New("API requires a user store")
+	}
 	a := &API{
 		router: mux.NewRouter(),
 		mdb:    db,
+		users:  users,
+
+		idempotency: newIdempotencyCache(DefaultIdempotencyWindow),
+		bodyLimit:   DefaultBodyLimit,
+		bodyLimits:  make(map[string]int64),
+	}
+	for path, limit := range defaultRouteBodyLimits {
+		a.bodyLimits[path] = limit
 	}
+	a.AddAuthenticator(&BasicAuthenticator{Users: users, Realm: "Please enter credentials:"})
+	a.AddAuthenticator(&keyAuthenticator{mdb: db})
 	a.SetRoutes()
 	return a, nil
 }
 
 func (a *API) SetRoutes() {
-	a.PublicPost("/public/message", a.postMessageHandler()) // unauthenticated
-	a.PrivatePut("/private/message", a.putMessageHandler())
-	a.PrivateGet("/private/message", a.getMessageHandler())
-	a.PrivateGet("/private/dump", a.getDumpHandler())
+	a.PublicPost("/public/message", a.rateLimited(a.idempotent(a.postMessageHandler()))) // unauthenticated
+	a.PrivateGet("/private/messages/{id}", PermRead, a.getMessageHandler())
+	a.PrivatePut("/private/messages/{id}", PermWrite, a.putMessageHandler())
+	a.PrivatePatch("/private/messages/{id}", PermWrite, a.patchMessageHandler())
+	a.PrivateDelete("/private/messages/{id}", PermDelete, a.deleteMessageHandler())
+	a.PrivateGet("/private/dump", PermRead, a.getDumpHandler())
+	a.PrivateGet("/private/messages", PermRead, a.getMessagesHandler())
+	a.PrivatePost("/private/messages/status", PermWrite, a.setStatusesHandler())
+	a.PrivatePost("/private/messages/{id}/status", PermWrite, a.setStatusHandler())
+	a.PrivateGet("/private/search", PermRead, a.getSearchHandler())
+	a.PrivateGet("/private/senders/messages", PermRead, a.findSenderMessagesHandler())
+	a.PrivateGet("/private/senders/{email}/messages", PermRead, a.getSenderMessagesHandler())
+	a.PrivatePost("/private/messages/{id}/restore", PermDelete, a.restoreMessageHandler())
+	a.PrivateGet("/private/messages/{id}/revisions", PermRead, a.getRevisionsHandler())
+	a.PrivateGet("/private/messages/{id}/revisions/{n}", PermRead, a.getRevisionHandler())
+	a.PrivatePost("/private/messages/{id}/revisions/{n}/rollback", PermWrite, a.rollbackHandler())
+	a.PrivatePost("/private/keys", PermKeys, a.createKeyHandler())
+	a.PrivateGet("/private/keys", PermKeys, a.getKeysHandler())
+	a.PrivateDelete("/private/keys/{id}", PermKeys, a.revokeKeyHandler())
+	a.PrivateGet("/private/audit", PermAudit, a.getAuditHandler())
+	a.PrivateGet("/private/reviews", PermModerate, a.getReviewsHandler())
+	a.PrivateGet("/private/reviews/{id}", PermModerate, a.getReviewHandler())
+	a.PrivatePost("/private/reviews/{id}/approve", PermModerate, a.approveReviewHandler())
+	a.PrivatePost("/private/reviews/{id}/reject", PermModerate, a.rejectReviewHandler())
+
+	//deprecated aliases of the /private/messages/{id} routes, which take the
+	//ID from the body on GET and PUT
+	a.PrivateGet("/private/message", PermRead, deprecated(a.getMessageHandler()))
+	a.PrivatePut("/private/message", PermWrite, deprecated(a.putMessageHandler()))
+
+	//aliases of the /private/messages/{id} routes under their old paths,
+	//which already took the ID from the path
+	a.PrivatePatch("/private/message/{id}", PermWrite, a.patchMessageHandler())
+	a.PrivateDelete("/private/message/{id}", PermDelete, a.deleteMessageHandler())
+	a.PrivatePost("/private/message/{id}/restore", PermDelete, a.restoreMessageHandler())
+	a.PrivateGet("/private/message/{id}/revisions", PermRead, a.getRevisionsHandler())
+	a.PrivateGet("/private/message/{id}/revisions/{n}", PermRead, a.getRevisionHandler())
+	a.PrivatePost("/private/message/{id}/revisions/{n}/rollback", PermWrite, a.rollbackHandler())
+}
+
+// deprecationDate is when the body-based message routes were deprecated,
+// sent in the Deprecation header (RFC 9745) of their responses
+const deprecationDate = 1792281600
+
+// deprecated wraps a handler kept for old clients, marking its responses as deprecated
+func deprecated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.Itoa(deprecationDate))
+		handler(w, r)
+	}
 }
 
 func (a *API) GetRouter() *mux.Router {
@@ -34,54 +106,60 @@ func (a *API) GetRouter() *mux.Router {
 }
 
 func (a *API) PublicGet(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, f).Methods("GET")
+	a.router.HandleFunc(path, a.limitBody(f)).Methods("GET")
 }
 
-func (a *API) PrivateGet(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, defaultAuth(f)).Methods("GET")
+func (a *API) PrivateGet(path string, perm Permission, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(a.audited(a.defaultAuth(requirePermission(f, perm))))).Methods("GET")
 }
 
 func (a *API) PublicPost(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, f).Methods("POST")
+	a.router.HandleFunc(path, a.limitBody(f)).Methods("POST")
 }
 
-func (a *API) PrivatePost(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, defaultAuth(f)).Methods("POST")
+func (a *API) PrivatePost(path string, perm Permission, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(a.audited(a.defaultAuth(requirePermission(f, perm))))).Methods("POST")
 }
 
 func (a *API) PublicPut(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, f).Methods("PUT")
+	a.router.HandleFunc(path, a.limitBody(f)).Methods("PUT")
 }
 
-func (a *API) PrivatePut(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, defaultAuth(f)).Methods("PUT")
+func (a *API) PrivatePut(path string, perm Permission, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(a.audited(a.defaultAuth(requirePermission(f, perm))))).Methods("PUT")
 }
 
-func (a *API) PublicDelete(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, f).Methods("DELETE")
+func (a *API) PublicPatch(path string, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(f)).Methods("PATCH")
 }
 
-func (a *API) PrivateDelete(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.router.HandleFunc(path, defaultAuth(f)).Methods("DELETE")
+func (a *API) PrivatePatch(path string, perm Permission, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(a.audited(a.defaultAuth(requirePermission(f, perm))))).Methods("PATCH")
 }
 
-func defaultAuth(handler http.HandlerFunc) http.HandlerFunc {
-	return basicAuth(handler, "admin", "back-challenge", "Please enter credentials:")
+func (a *API) PublicDelete(path string, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(f)).Methods("DELETE")
 }
 
-func basicAuth(handler http.HandlerFunc, username, password, realm string) http.HandlerFunc {
-
-	return func(w http.ResponseWriter, r *http.Request) {
+func (a *API) PrivateDelete(path string, perm Permission, f func(w http.ResponseWriter, r *http.Request)) {
+	a.router.HandleFunc(path, a.limitBody(a.audited(a.defaultAuth(requirePermission(f, perm))))).Methods("DELETE")
+}
 
-		user, pass, ok := r.BasicAuth()
+// AddAuthenticator appends a strategy to the chain tried on private routes
+func (a *API) AddAuthenticator(auth Authenticator) {
+	a.auth = append(a.auth, auth)
+}
 
-		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
-			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorised.\n"))
+// defaultAuth wraps a private handler, passing on the caller identified by
+// the authenticator chain, or answering 401 if no strategy accepts the request
+func (a *API) defaultAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := authenticate(a.auth, r)
+		if err != nil {
+			unauthorisedHandler(w, a.auth)
 			return
 		}
-
-		handler(w, r)
+		auditPrincipal(r, principal.Name)
+		handler(w, withPrincipal(r, principal))
 	}
 }
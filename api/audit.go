@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+const (
+	requestIDHeader   = "X-Request-ID"
+	maxRequestIDBytes = 128
+)
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through, so that streamed responses still stream
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// audited wraps a private handler, recording the call in the audit log
+// it runs before authentication, so that calls whose credentials are refused
+// are recorded too, without a principal. Handlers which change messages do so
+// through dbFor, which records an entry for each change alongside it. Calls
+// which change nothing, including those refused, are recorded afterwards with
+// the status of their response
+func (a *API) audited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		route := routeTemplate(r)
+		audit := &db.Audit{Entry: types.AuditEntry{
+			Time:      time.Now().UnixNano(),
+			Method:    r.Method,
+			Route:     route,
+			ClientIP:  a.clientIP(r),
+			RequestID: requestID,
+		}}
+		if messageRoute(route) {
+			audit.Entry.MessageID = mux.Vars(r)["id"]
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r.WithContext(context.WithValue(r.Context(), auditKey, audit)))
+
+		if audit.Written == 0 {
+			entry := audit.Entry
+			entry.Status = rec.status
+			if err := a.mdb.InsertAudit(&entry); err != nil {
+				log.Printf("Error writing audit entry for request %s: %s", requestID, err)
+			}
+		}
+	}
+}
+
+// dbFor returns the database handle a request should write through,
+// which audits the changes it makes
+func (a *API) dbFor(r *http.Request) *db.MessageDB {
+	if audit, ok := r.Context().Value(auditKey).(*db.Audit); ok {
+		return a.mdb.WithAudit(audit)
+	}
+	return a.mdb
+}
+
+// auditMessage records the message a request is about, for routes which
+// take its ID from the body rather than the path
+func auditMessage(r *http.Request, ID string) {
+	if audit, ok := r.Context().Value(auditKey).(*db.Audit); ok {
+		audit.Entry.MessageID = ID
+	}
+}
+
+// auditPrincipal records the caller of a request, once it is authenticated
+func auditPrincipal(r *http.Request, name string) {
+	if audit, ok := r.Context().Value(auditKey).(*db.Audit); ok {
+		audit.Entry.Principal = name
+	}
+}
+
+// messageRoutes are the prefixes of the route templates whose {id} is a
+// message ID. A review is known by the ID of the message it holds, while the
+// {id} of other routes, such as an API key's, is not a message's
+var messageRoutes = []string{"/private/messages/{id}", "/private/message/{id}", "/private/reviews/{id}"}
+
+// messageRoute reports whether the {id} of a route template is a message ID
+func messageRoute(template string) bool {
+	for _, prefix := range messageRoutes {
+		if strings.HasPrefix(template, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// validRequestID accepts client supplied request IDs of a sane length and
+// character set, so that they can be logged safely
+func validRequestID(ID string) bool {
+	if ID == "" || len(ID) > maxRequestIDBytes {
+		return false
+	}
+	for _, c := range ID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// auditPage is the body of an audit log listing
+type auditPage struct {
+	Entries    []*types.AuditEntry `json:"entries"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// getAuditHandler handles an audit log query
+// it takes optional principal, message, method and route filters, from and to
+// bounds as for the time range query, and an order, limit and cursor
+// it returns a page of matching entries, newest first by default
+func (a *API) getAuditHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		start, end, param, err := parseTimeRange(query)
+		if err != nil {
+			queryErrorHandler(w, "getAudit", param, err)
+			return
+		}
+		ascending, err := parseOrder(query)
+		if err != nil {
+			queryErrorHandler(w, "getAudit", "order", err)
+			return
+		}
+		limit, err := parseLimit(query, defaultPageLimit)
+		if err != nil {
+			queryErrorHandler(w, "getAudit", "limit", err)
+			return
+		}
+		var after uint64
+		if cursor := query.Get("cursor"); cursor != "" {
+			after, err = strconv.ParseUint(cursor, 10, 64)
+			if err != nil || after == 0 {
+				queryErrorHandler(w, "getAudit", "cursor", errors.New("Malformed cursor"))
+				return
+			}
+		}
+		filter := db.AuditFilter{
+			Principal: query.Get("principal"),
+			MessageID: query.Get("message"),
+			Method:    query.Get("method"),
+			Route:     query.Get("route"),
+			Start:     start,
+			End:       end,
+		}
+
+		//fetch one extra entry to find out whether there is a next page
+		entries, err := a.mdb.FetchAudit(filter, ascending, after, limit+1)
+		if err != nil {
+			internalErrorHandler(w, "getAudit", err)
+			return
+		}
+		page := auditPage{Entries: entries}
+		if len(entries) > limit {
+			page.Entries = entries[:limit]
+			page.NextCursor = strconv.FormatUint(page.Entries[limit-1].Seq, 10)
+			setNextLink(w, r, page.NextCursor)
+		}
+		if page.Entries == nil {
+			page.Entries = []*types.AuditEntry{}
+		}
+
+		pageJSON, err := json.MarshalIndent(page, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getAudit", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(pageJSON)
+	}
+}
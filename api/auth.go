@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Authenticator is one strategy for identifying the caller of a private route
+type Authenticator interface {
+	// Authenticate returns the caller, ErrNoCredentials if the request has no
+	// credentials of this kind, or another error if its credentials are not valid
+	Authenticate(r *http.Request) (*Principal, error)
+
+	// Challenge is sent in the WWW-Authenticate header of a 401 response
+	Challenge() string
+}
+
+var (
+	// ErrNoCredentials is returned by an Authenticator which does not recognise
+	// the request's credentials, so that the next in the chain is tried
+	ErrNoCredentials = errors.New("No credentials")
+
+	// ErrBadCredentials is returned by an Authenticator which recognises the
+	// request's credentials, but does not accept them
+	ErrBadCredentials = errors.New("Invalid credentials")
+)
+
+// authenticate tries each strategy in turn. The first to recognise the
+// request's credentials decides, so that a rejected credential never falls
+// through to a later strategy
+func authenticate(chain []Authenticator, r *http.Request) (*Principal, error) {
+	for _, auth := range chain {
+		principal, err := auth.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return principal, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// BasicAuthenticator checks HTTP basic auth credentials against a UserStore
+type BasicAuthenticator struct {
+	Users *UserStore
+	Realm string
+}
+
+func (b *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	principal, ok := b.Users.Authenticate(user, pass)
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	return principal, nil
+}
+
+func (b *BasicAuthenticator) Challenge() string {
+	return `Basic realm="` + b.Realm + `"`
+}
+
+// bearerToken returns the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) (string, bool) {
+	const scheme = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme):]), true
+}
+
+// unauthorisedHandler answers 401, challenging the client with every strategy in the chain
+func unauthorisedHandler(w http.ResponseWriter, chain []Authenticator) {
+	for _, auth := range chain {
+		w.Header().Add("WWW-Authenticate", auth.Challenge())
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Unauthorised.\n"))
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// DefaultBodyLimit is the most bytes a request body may hold on routes
+// without a limit of their own, unless set otherwise
+const DefaultBodyLimit = 64 << 10
+
+// defaultRouteBodyLimits are the routes with a limit of their own. A public
+// message is at most a few kilobytes, even with every character escaped
+var defaultRouteBodyLimits = map[string]int64{
+	"/public/message": 32 << 10,
+}
+
+var errUnsupportedMediaType = errors.New("Request body must be sent as application/json")
+
+// bodyTooLargeError is the error reading a request body past its limit
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	return "Request body must be at most " + strconv.FormatInt(e.limit, 10) + " bytes"
+}
+
+// limitedBody is a request body cut off at limit bytes by http.MaxBytesReader,
+// which is told apart from other read errors
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		err = &bodyTooLargeError{b.limit}
+	}
+	return n, err
+}
+
+// SetBodyLimits sets the most bytes a request body may hold, for every route
+// and for the routes given by path template, which override the defaults for
+// those routes. A limit of zero is no limit
+func (a *API) SetBodyLimits(limit int64, routes map[string]int64) {
+	a.bodyLimit = limit
+	for path, routeLimit := range routes {
+		a.bodyLimits[path] = routeLimit
+	}
+}
+
+// ParseBodyLimits reads a list of route body limits, as path=bytes pairs
+// separated by commas
+func ParseBodyLimits(raw string) (map[string]int64, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	limits := make(map[string]int64)
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Malformed body limit " + pair + ", expected path=bytes")
+		}
+		limit, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || limit < 0 {
+			return nil, errors.New("Invalid body limit " + parts[1] + " for " + parts[0])
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+func (a *API) routeBodyLimit(r *http.Request) int64 {
+	if route := mux.CurrentRoute(r); route != nil {
+		if path, err := route.GetPathTemplate(); err == nil {
+			if limit, ok := a.bodyLimits[path]; ok {
+				return limit
+			}
+		}
+	}
+	return a.bodyLimit
+}
+
+// limitBody wraps a handler, cutting the request body off at the route's
+// limit. Bodies declared larger than the limit are refused with 413 unread
+func (a *API) limitBody(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := a.routeBodyLimit(r)
+		if limit > 0 && r.Body != nil {
+			if r.ContentLength > limit {
+				bodyErrorHandler(w, "limitBody", &bodyTooLargeError{limit})
+				return
+			}
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+		}
+		handler(w, r)
+	}
+}
+
+// readBody reads a JSON request body, refusing any other content type
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, errors.New("Request had no body")
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil, errUnsupportedMediaType
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+// decodeJSON reads a JSON request body into v. The body must hold exactly
+// one JSON value, and if strict, no fields v does not have
+func decodeJSON(r *http.Request, v interface{}, strict bool) error {
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("Request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// bodyErrorHandler answers a request whose body could not be read: 413 if
+// it was too large, 415 if it was not JSON, and otherwise 400
+func bodyErrorHandler(w http.ResponseWriter, handlerID string, err error) {
+	if _, ok := err.(*bodyTooLargeError); ok {
+		writeProblem(w, http.StatusRequestEntityTooLarge, err.Error(), nil)
+		return
+	}
+	if err == errUnsupportedMediaType {
+		writeProblem(w, http.StatusUnsupportedMediaType, err.Error(), nil)
+		return
+	}
+	badRequestHandler(w, handlerID, err)
+}
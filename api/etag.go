@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/imw-challenge/back/types"
+)
+
+// etag is the entity tag of a version of a message
+func etag(message *types.Message) string {
+	return `"` + strconv.Itoa(message.Version) + `"`
+}
+
+// ifMatch turns the If-Match headers of a request into a precondition on the
+// current message, or nil if there are none. Tags are compared strongly,
+// as RFC 7232 requires, so weak tags never match
+func ifMatch(r *http.Request) func(*types.Message) bool {
+	header := strings.Join(r.Header["If-Match"], ",")
+	if header == "" {
+		return nil
+	}
+	return func(current *types.Message) bool {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || tag == etag(current) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func preconditionFailedHandler(w http.ResponseWriter, handlerID string) {
+	writeProblem(w, http.StatusPreconditionFailed, "The message has changed since its ETag was read", nil)
+}
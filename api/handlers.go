@@ -6,144 +6,448 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/moderation"
+	"github.com/imw-challenge/back/search"
 	"github.com/imw-challenge/back/types"
 )
 
 // postMessageHandler handles a post message request
-// it checks that there is a well-formed body, containing at least an ID and text
-// and inserts to the DB
+// it checks that there is a well-formed body, containing at least text, with
+// every field valid, and inserts to the DB
+// if the ID is left out a UUID is generated, and if the time is left out
+// the message is stamped with the server's clock
+// it returns 201 with the stored message, and its location
+// if a message with this ID is already stored, it returns 200 with that message
+// without storing anything if the message is the same, or 409 if it is not,
+// so that messages cannot be overwritten through this route
+// only then is the message moderated: rejected messages are refused with 422,
+// and quarantined ones are held for review and answered with 202
+// if storing the message would take the stored messages past the API's cap,
+// it returns 503
 func (a *API) postMessageHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Body == nil {
-			badRequestHandler(w, "postMessage", errors.New("Request had no body"))
+		m := &types.Message{ID: newMessageID(), Time: time.Now().Unix()}
+		err := readMessage(r, m, "text")
+		if err != nil {
+			bodyErrorHandler(w, "postMessage", err)
 			return
 		}
-		decoder := json.NewDecoder(r.Body)
-		var m types.Message
-		err := decoder.Decode(&m)
-		if err != nil {
-			badRequestHandler(w, "postMessage", err)
+		//repeats of an earlier post store nothing, so are answered before
+		//they are charged to the cap or counted by moderation
+		stored, err := a.mdb.FetchPosted(m)
+		if err != db.ErrNotFound {
+			a.answerPost(w, m, stored, false, err)
 			return
 		}
-		if len(m.ID) == 0 || len(m.Text) == 0 {
-			badRequestHandler(w, "postMessage", errors.New("No ID or Text in request"))
+		if a.maxStoredBytes > 0 && a.mdb.StoredBytes()+db.NewMessageSize(m) > a.maxStoredBytes {
+			writeProblem(w, http.StatusServiceUnavailable, "The message store is full", nil)
 			return
 		}
-		err = a.mdb.InsertMessage(&m)
-		if err != nil {
-			internalErrorHandler(w, "postMessage", err)
+		verdict := a.moderate(m)
+		switch verdict.Action {
+		case moderation.Reject:
+			log.Printf("Rejected message %s: %s", m.ID, strings.Join(verdict.Reasons, ", "))
+			writeProblem(w, http.StatusUnprocessableEntity, "The message was rejected", nil)
+			return
+		case moderation.Quarantine:
+			a.holdMessage(w, m, verdict.Reasons)
 			return
 		}
-		w.Write([]byte{})
+		stored, created, err := a.mdb.CreateMessage(m)
+		a.answerPost(w, m, stored, created, err)
 	}
 }
 
+// answerPost writes the response to a posted message, from the message as
+// stored and whether it was created by this post
+func (a *API) answerPost(w http.ResponseWriter, m, stored *types.Message, created bool, err error) {
+	if err == db.ErrConflict {
+		writeProblem(w, http.StatusConflict, "A different message with ID "+m.ID+" already exists", nil)
+		return
+	}
+	if err == db.ErrHeld {
+		//held when first posted, so still held however it moderates now
+		a.holdMessage(w, m, nil)
+		return
+	}
+	if err != nil {
+		internalErrorHandler(w, "postMessage", err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/private/messages/"+stored.ID)
+	}
+	w.Header().Set("ETag", etag(stored))
+	writeMessage(w, "postMessage", status, stored)
+}
+
 // putMessageHandler handles a put message request
-// it checks that the request has a well-formed body containing an ID and text
+// it takes the message ID from the path, or on the deprecated body route from
+// the body, and checks that the request has a well-formed body containing
+// text, with every field valid
 // if a message with this ID exists, it updates the text
 // otherwise, it returns 404
+// if an If-Match header is given and no longer matches the message's ETag,
+// it returns 412 without updating
 func (a *API) putMessageHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		if r.Body == nil {
-			badRequestHandler(w, "putMessage", errors.New("Request had no body"))
-			return
+		ID, fromPath := mux.Vars(r)["id"]
+		required := []string{"text"}
+		if !fromPath {
+			required = append(required, "id")
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var m types.Message
-		err := decoder.Decode(&m)
+		m := &types.Message{}
+		err := readMessage(r, m, required...)
 		if err != nil {
-			badRequestHandler(w, "putMessage", err)
+			bodyErrorHandler(w, "putMessage", err)
 			return
 		}
-		if len(m.ID) == 0 || len(m.Text) == 0 {
-			badRequestHandler(w, "putMessage", errors.New("No ID or Text in request"))
+		if fromPath {
+			if m.ID != "" && m.ID != ID {
+				badRequestHandler(w, "putMessage", validationError{{"id", "does not match the path"}})
+				return
+			}
+			m.ID = ID
+		}
+		auditMessage(r, m.ID)
+		updated, err := a.dbFor(r).UpdateMessage(m.ID, ifMatch(r), func(message *types.Message) error {
+			message.Text = m.Text
+			return nil
+		})
+		if err == db.ErrNotFound {
+			notFoundHandler(w, m.ID, "putMessage")
 			return
 		}
-		message, err := a.mdb.FetchByID(m.ID)
-		if err != nil {
-			notFoundHandler(w, m.ID, "putMessage - fetchyByID")
+		if err == db.ErrPreconditionFailed {
+			preconditionFailedHandler(w, "putMessage")
 			return
 		}
-		message.Text = m.Text
-		err = a.mdb.InsertMessage(message)
 		if err != nil {
 			internalErrorHandler(w, "putMessage", err)
 			return
 		}
+		w.Header().Set("ETag", etag(updated))
 		w.Write([]byte{})
 	}
 }
 
 // getMessageHandler handles a get message request
-// it checks that there is a well-formed request body containing an ID
+// it takes the message ID from the path, or on the deprecated body route,
+// checks that there is a well-formed request body containing an ID
 // it returns 404 if this message is not in the db, otherwise returning
-// the message as pretty-printed JSON
+// the message as pretty-printed JSON, with its version as the ETag
 func (a *API) getMessageHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Body == nil {
-			badRequestHandler(w, "getMessage", errors.New("Request had no body"))
+		ID, ok := mux.Vars(r)["id"]
+		if !ok {
+			var m types.Message
+			if err := readMessage(r, &m, "id"); err != nil {
+				bodyErrorHandler(w, "getMessage", err)
+				return
+			}
+			ID = m.ID
+		}
+		auditMessage(r, ID)
+		message, err := a.mdb.FetchByID(ID)
+		if err != nil {
+			notFoundHandler(w, ID, "getMessage - fetchyByID")
+			return
+		}
+		messageJSON, err := json.MarshalIndent(message, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getMessage", err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(message))
+		w.Write(messageJSON)
+	}
+}
 
-		decoder := json.NewDecoder(r.Body)
-		var m types.Message
-		err := decoder.Decode(&m)
+// getDumpHandler handles a get dump request
+// it streams all of the messages in reverse chronoligcal order,
+// as a pretty-printed JSON array, or as NDJSON if the client accepts it
+// if a status query parameter is given, only messages in that status are dumped
+// if a limit or cursor query parameter is given, it returns a single page instead
+func (a *API) getDumpHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		status, err := parseStatus(query)
 		if err != nil {
-			badRequestHandler(w, "getMessage", err)
+			queryErrorHandler(w, "getDump", "status", err)
 			return
 		}
-		if len(m.ID) == 0 {
-			badRequestHandler(w, "getMessages", errors.New("No ID in request"))
+		if query.Get("limit") != "" || query.Get("cursor") != "" {
+			writeMessagePage(w, r, "getDump", func(after *db.Cursor, limit int) ([]*types.Message, error) {
+				return a.mdb.FetchStatusPage(status, 0, math.MaxInt64, false, after, limit)
+			})
+			return
+		}
+
+		//this streams all messages, starting with the latest
+		streamMessages(w, r, "getDump", func(fn func(*types.Message) error) error {
+			return a.mdb.ScanByStatus(status, 0, math.MaxInt64, false, fn)
+		})
+	}
+}
+
+// deleteMessageHandler handles a delete message request
+// it takes the message ID from the path, and returns 404 if there is no such message
+// whether the message is removed or soft-deleted depends on the database's mode
+func (a *API) deleteMessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		err := a.dbFor(r).DeleteMessage(ID)
+		if err == db.ErrNotFound {
+			notFoundHandler(w, ID, "deleteMessage")
 			return
 		}
-		message, err := a.mdb.FetchByID(m.ID)
 		if err != nil {
-			notFoundHandler(w, m.ID, "getMessage - fetchyByID")
+			internalErrorHandler(w, "deleteMessage", err)
+			return
+		}
+		w.Write([]byte{})
+	}
+}
+
+// restoreMessageHandler handles a restore message request
+// it takes the message ID from the path, and brings back a soft-deleted message
+// it returns 404 if there is no deleted message with this ID
+func (a *API) restoreMessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		err := a.dbFor(r).RestoreMessage(ID)
+		if err == db.ErrNotFound {
+			notFoundHandler(w, ID, "restoreMessage")
 			return
 		}
-		messageJSON, err := json.MarshalIndent(message, "", "    ")
 		if err != nil {
-			internalErrorHandler(w, "getMessage", err)
+			internalErrorHandler(w, "restoreMessage", err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(messageJSON)
+		w.Write([]byte{})
 	}
 }
 
-// getDumpHandler handles a get dump request
-// it fetches all of the messages in reverse chronoligcal order,
-// and returns them as a pretty-printed JSON array
-func (a *API) getDumpHandler() http.HandlerFunc {
+// getMessagesHandler handles a time range query
+// it takes optional from and to query parameters, as RFC3339 or unix seconds,
+// an order of asc or desc (the default), a status to list only the messages
+// in, and the limit and cursor of a page
+// it returns a page of the messages in that range, or 400 with a JSON error
+// naming the offending parameter
+func (a *API) getMessagesHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		//this fetches all messages, starting with the latest
-		messages, err := a.mdb.FetchSortedByTime(0, math.MaxInt64, false)
+		query := r.URL.Query()
+		start, end, param, err := parseTimeRange(query)
+		if err != nil {
+			queryErrorHandler(w, "getMessages", param, err)
+			return
+		}
+
+		ascending, err := parseOrder(query)
 		if err != nil {
-			internalErrorHandler(w, "getDump", err)
+			queryErrorHandler(w, "getMessages", "order", err)
 			return
 		}
-		messagesJSON, err := json.MarshalIndent(messages, "", "    ")
+
+		status, err := parseStatus(query)
 		if err != nil {
-			internalErrorHandler(w, "getDump", err)
+			queryErrorHandler(w, "getMessages", "status", err)
+			return
+		}
+
+		writeMessagePage(w, r, "getMessages", func(after *db.Cursor, limit int) ([]*types.Message, error) {
+			return a.mdb.FetchStatusPage(status, start, end, ascending, after, limit)
+		})
+	}
+}
+
+// getSenderMessagesHandler handles a request for the messages from one sender
+// it takes the email address from the path, which is matched case-insensitively,
+// and an order, limit and cursor as for the time range query
+// it returns a page of the sender's messages, sorted by time
+func (a *API) getSenderMessagesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email := mux.Vars(r)["email"]
+		ascending, err := parseOrder(r.URL.Query())
+		if err != nil {
+			queryErrorHandler(w, "getSenderMessages", "order", err)
+			return
+		}
+		writeMessagePage(w, r, "getSenderMessages", func(after *db.Cursor, limit int) ([]*types.Message, error) {
+			return a.mdb.FetchByEmail(email, ascending, after, limit)
+		})
+	}
+}
+
+// findSenderMessagesHandler handles a request for the messages from senders
+// matching a name or the start of an email address
+// it takes exactly one of name, matched exactly, and email_prefix, matched
+// case-insensitively, and an order, limit and cursor as for the time range query
+// it returns a page of the matching messages, sorted by time
+func (a *API) findSenderMessagesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		name, prefix := query.Get("name"), query.Get("email_prefix")
+		if (name == "") == (prefix == "") {
+			queryErrorHandler(w, "findSenderMessages", "name", errors.New("exactly one of name and email_prefix is required"))
+			return
+		}
+		ascending, err := parseOrder(query)
+		if err != nil {
+			queryErrorHandler(w, "findSenderMessages", "order", err)
+			return
+		}
+		writeMessagePage(w, r, "findSenderMessages", func(after *db.Cursor, limit int) ([]*types.Message, error) {
+			if name != "" {
+				return a.mdb.FetchByName(name, ascending, after, limit)
+			}
+			return a.mdb.FetchByEmailPrefix(prefix, ascending, after, limit)
+		})
+	}
+}
+
+// getSearchHandler handles a full-text search request
+// it takes a query q over message text, name and email, optional from and to
+// bounds as for the time range query, and a limit on the number of results
+// it returns the matching messages, most relevant first, each with its score
+// and a snippet of the text with the matched terms highlighted
+func (a *API) getSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q, err := search.ParseQuery(query.Get("q"))
+		if err != nil {
+			queryErrorHandler(w, "getSearch", "q", err)
+			return
+		}
+		start, end, param, err := parseTimeRange(query)
+		if err != nil {
+			queryErrorHandler(w, "getSearch", param, err)
+			return
+		}
+		limit, err := parseLimit(query, defaultSearchLimit)
+		if err != nil {
+			queryErrorHandler(w, "getSearch", "limit", err)
+			return
+		}
+
+		results, err := a.mdb.Search(q, start, end, limit)
+		if err != nil {
+			internalErrorHandler(w, "getSearch", err)
+			return
+		}
+		response := searchResponse{Results: []searchResult{}}
+		for _, result := range results {
+			snippet, ok := q.Snippet(result.Message.Text, snippetWords)
+			if !ok {
+				//the match was on name or email
+				snippet, _ = q.Snippet(result.Message.Name+" <"+result.Message.Email+">", snippetWords)
+			}
+			response.Results = append(response.Results, searchResult{
+				Message: result.Message,
+				Score:   result.Score,
+				Snippet: snippet,
+			})
+		}
+
+		responseJSON, err := json.MarshalIndent(response, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getSearch", err)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(messagesJSON)
+		w.Write(responseJSON)
 	}
 }
 
+// writeMessagePage writes one page of messages from fetch,
+// as selected by the limit and cursor query parameters
+// the page is an object holding the messages, and a next_cursor if there are more
+// the next page is also linked from the Link header
+func writeMessagePage(w http.ResponseWriter, r *http.Request, handlerID string, fetch pageFunc) {
+	query := r.URL.Query()
+	limit, err := parseLimit(query, defaultPageLimit)
+	if err != nil {
+		queryErrorHandler(w, handlerID, "limit", err)
+		return
+	}
+	var after *db.Cursor
+	if token := query.Get("cursor"); token != "" {
+		after, err = decodeCursor(token)
+		if err != nil {
+			queryErrorHandler(w, handlerID, "cursor", err)
+			return
+		}
+	}
+
+	//fetch one extra message to find out whether there is a next page
+	messages, err := fetch(after, limit+1)
+	if err != nil {
+		internalErrorHandler(w, handlerID, err)
+		return
+	}
+	page := messagePage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		page.NextCursor = encodeCursor(page.Messages[limit-1])
+		setNextLink(w, r, page.NextCursor)
+	}
+	if page.Messages == nil {
+		page.Messages = []*types.Message{}
+	}
+
+	pageJSON, err := json.MarshalIndent(page, "", "    ")
+	if err != nil {
+		internalErrorHandler(w, handlerID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(pageJSON)
+}
+
 func internalErrorHandler(w http.ResponseWriter, handlerID string, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
+	writeProblem(w, http.StatusInternalServerError, "", nil)
 	log.Printf("Internal error in %s: %s", handlerID, err)
 }
 
+// badRequestHandler answers 400 with a problem listing each invalid field,
+// or describing why the body could not be read
 func badRequestHandler(w http.ResponseWriter, handlerID string, err error) {
-	w.WriteHeader(http.StatusBadRequest)
+	if invalid, ok := err.(validationError); ok {
+		writeProblem(w, http.StatusBadRequest, "The request has invalid fields", invalid)
+		return
+	}
+	writeProblem(w, http.StatusBadRequest, err.Error(), nil)
 }
 
 func notFoundHandler(w http.ResponseWriter, resourceID string, handlerID string) {
-	w.WriteHeader(http.StatusNotFound)
+	writeProblem(w, http.StatusNotFound, resourceID+" was not found", nil)
+}
+
+const (
+	defaultSearchLimit = 20
+	snippetWords       = 20
+)
+
+// searchResponse is the body of a search response
+type searchResponse struct {
+	Results []searchResult `json:"results"`
+}
+
+type searchResult struct {
+	Message *types.Message `json:"message"`
+	Score   float64        `json:"score"`
+	Snippet string         `json:"snippet"`
+}
+
+// queryErrorHandler answers 400 with a problem naming the malformed query parameter
+func queryErrorHandler(w http.ResponseWriter, handlerID string, param string, err error) {
+	writeProblem(w, http.StatusBadRequest, err.Error(), []invalidParam{{param, err.Error()}})
 }
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultIdempotencyWindow is how long the response to a request with an
+	// Idempotency-Key is kept for replay, unless set otherwise
+	DefaultIdempotencyWindow = 24 * time.Hour
+
+	maxIdempotencyKeyLength = 255
+
+	//the most responses kept at once, after which the oldest are forgotten early
+	maxIdempotencyResponses = 100000
+)
+
+// idempotentResponse is a response kept for replay, along with a hash of the
+// request it answered, so a key reused for another request can be refused
+type idempotentResponse struct {
+	key      string
+	request  [sha256.Size]byte
+	answered time.Time
+	done     bool //false while the first request with the key is being handled
+	status   int
+	header   http.Header
+	body     []byte
+}
+
+// idempotencyCache holds the responses to requests sent with an
+// Idempotency-Key header, for window after they were first answered. Keys are
+// those of the client which sent them, so that clients cannot see each
+// other's responses
+type idempotencyCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	responses map[string]*idempotentResponse
+	order     []*idempotentResponse //kept responses in the order they were answered
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{window: window, responses: make(map[string]*idempotentResponse)}
+}
+
+// SetIdempotencyWindow sets how long responses to requests with an
+// Idempotency-Key header are kept, including those kept already
+func (a *API) SetIdempotencyWindow(window time.Duration) {
+	a.idempotency.mu.Lock()
+	a.idempotency.window = window
+	a.idempotency.mu.Unlock()
+}
+
+// begin claims key for a request, returning the response already kept for
+// it, if any. It returns 0 if the caller should handle the request and then
+// call finish, or the status to refuse the request with: 409 while the key is
+// claimed by a request still being handled, or 422 if the key was used for a
+// different request
+func (c *idempotencyCache) begin(key string, request [sha256.Size]byte, now time.Time) (*idempotentResponse, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	for len(c.responses) >= maxIdempotencyResponses && len(c.order) > 0 {
+		c.forget(c.order[0])
+		c.order = c.order[1:]
+	}
+
+	if kept, ok := c.responses[key]; ok {
+		switch {
+		case kept.request != request:
+			return nil, http.StatusUnprocessableEntity
+		case !kept.done:
+			return nil, http.StatusConflict
+		}
+		return kept, 0
+	}
+	c.responses[key] = &idempotentResponse{key: key, request: request}
+	return nil, 0
+}
+
+// finish keeps the response to a request which claimed key. Server errors,
+// and client errors other than 409, are not kept, so the request can be
+// retried with the same key once whatever was wrong with it is put right
+func (c *idempotencyCache) finish(key string, status int, header http.Header, body []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.responses[key]
+	if kept == nil || kept.done {
+		return
+	}
+	if status >= http.StatusBadRequest && status != http.StatusConflict {
+		delete(c.responses, key)
+		return
+	}
+	kept.done = true
+	kept.status = status
+	kept.header = header
+	kept.body = body
+	kept.answered = now
+	c.order = append(c.order, kept)
+}
+
+// release frees a key claimed by a request which was not answered
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if kept := c.responses[key]; kept != nil && !kept.done {
+		delete(c.responses, key)
+	}
+}
+
+// expire forgets responses past their window. Call with mu held
+func (c *idempotencyCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(c.order) && !now.Before(c.order[i].answered.Add(c.window)); i++ {
+		c.forget(c.order[i])
+	}
+	c.order = c.order[i:]
+}
+
+// forget drops a kept response, as it leaves the front of order. Call with mu held
+func (c *idempotencyCache) forget(kept *idempotentResponse) {
+	if c.responses[kept.key] == kept {
+		delete(c.responses, kept.key)
+	}
+}
+
+// idempotent wraps a handler so that a request with an Idempotency-Key header
+// is handled at most once in the cache's window. Repeats of the request get
+// the first response again, marked with an Idempotent-Replayed header
+func (a *API) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeProblem(w, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters", nil)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(r.Body); err != nil {
+				bodyErrorHandler(w, "idempotent", err)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		//a client's keys are its own
+		key = a.clientIP(r) + " " + key
+		request := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		kept, refused := a.idempotency.begin(key, request, time.Now())
+		switch refused {
+		case http.StatusConflict:
+			writeProblem(w, refused, "A request with this Idempotency-Key is still being handled", nil)
+			return
+		case http.StatusUnprocessableEntity:
+			writeProblem(w, refused, "This Idempotency-Key was used for a different request", nil)
+			return
+		}
+		if kept != nil {
+			for name, values := range kept.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(kept.status)
+			w.Write(kept.body)
+			return
+		}
+
+		//if the handler panics, free the key so the request can be retried
+		answered := false
+		defer func() {
+			if !answered {
+				a.idempotency.release(key)
+			}
+		}()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		answered = true
+		a.idempotency.finish(key, recorder.status, cloneHeader(w.Header()), recorder.body.Bytes(), time.Now())
+	}
+}
+
+// responseRecorder passes a response through, keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	jwksMaxBytes     = 1 << 20
+
+	//the shortest RSA modulus accepted, as RFC 7518 requires
+	minRSABits = 2048
+
+	//an unknown kid triggers a refetch at most this often, so that tokens
+	//naming made-up keys cannot be used to hammer the identity provider
+	jwksMinRefresh = 30 * time.Second
+)
+
+// jwk is a single JSON Web Key, as in RFC 7517. Only public RSA and EC
+// signing keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey is a verification key from a JWKS, and the algorithm it is pinned to, if any
+type publicKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet caches the keys read from a JWKS file or URL. The keys are
+// refetched once they are older than refresh, or sooner when a token names
+// a key not in the cache, so that keys rotated by the provider are picked up.
+// If a refetch fails, the keys already loaded are kept
+type keySet struct {
+	source     string
+	refresh    time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	fetchMu   sync.Mutex //held by the request refetching stale keys
+	mu        sync.Mutex
+	keys      []publicKey
+	fetched   time.Time //last successful fetch
+	attempted time.Time //last fetch, successful or not
+}
+
+func newKeySet(source string, refresh time.Duration) (*keySet, error) {
+	s := &keySet{
+		source:     source,
+		refresh:    refresh,
+		minRefresh: jwksMinRefresh,
+		client:     &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload refetches the keys from the key set's source
+func (s *keySet) Reload() error {
+	s.mu.Lock()
+	s.attempted = time.Now()
+	s.mu.Unlock()
+
+	raw, err := s.read()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.fetched = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *keySet) read() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return ioutil.ReadFile(s.source)
+	}
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Fetching JWKS returned " + resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, jwksMaxBytes))
+}
+
+// lookup returns the keys which may have signed a token with the given kid
+// and algorithm, refetching the set if it is stale or the kid is unknown
+func (s *keySet) lookup(kid, alg string) []publicKey {
+	s.mu.Lock()
+	keys := matchKeys(s.keys, kid, alg)
+	stale := s.stale(len(keys) == 0)
+	s.mu.Unlock()
+	if !stale {
+		return keys
+	}
+
+	//one request refetches while the rest wait, then all check again
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	s.mu.Lock()
+	stale = s.stale(len(matchKeys(s.keys, kid, alg)) == 0)
+	s.mu.Unlock()
+	if stale {
+		//on error, keep verifying against the cached keys until the source recovers
+		s.Reload()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return matchKeys(s.keys, kid, alg)
+}
+
+// stale reports whether the keys should be refetched, at most once per
+// minRefresh, whether or not the last attempt succeeded. Call with mu held
+func (s *keySet) stale(missing bool) bool {
+	if time.Since(s.attempted) < s.minRefresh {
+		return false
+	}
+	return missing || time.Since(s.fetched) > s.refresh
+}
+
+func matchKeys(keys []publicKey, kid, alg string) []publicKey {
+	var matched []publicKey
+	for _, k := range keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		matched = append(matched, k)
+	}
+	return matched
+}
+
+// parseJWKS reads the signing keys from a JWKS document, skipping keys of
+// types we do not use
+func parseJWKS(raw []byte) ([]publicKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var keys []publicKey
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaKey()
+		case "EC":
+			key, err = k.ecKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.New("Invalid key " + k.Kid + " in JWKS: " + err.Error())
+		}
+		keys = append(keys, publicKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k *jwk) rsaKey() (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA exponent")
+	}
+	if n.BitLen() < minRSABits {
+		return nil, errors.New("RSA key is shorter than " + strconv.Itoa(minRSABits) + " bits")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jwk) ecKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, errors.New("unsupported curve " + k.Crv)
+	}
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on the curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(raw string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" //register the hashes used by the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtLeeway allows for clock skew between us and the identity provider
+const jwtLeeway = time.Minute
+
+// jwtAlgorithm is how a JWS algorithm signs: the hash of the signing input,
+// and for ECDSA the one curve its keys must be on. RSA algorithms have no curve
+type jwtAlgorithm struct {
+	hash  crypto.Hash
+	curve elliptic.Curve
+}
+
+// jwtAlgorithms are the JWS algorithms accepted, all asymmetric,
+// so that a public key can never be used as an HMAC secret
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256},
+	"RS384": {hash: crypto.SHA384},
+	"RS512": {hash: crypto.SHA512},
+	"ES256": {hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {hash: crypto.SHA512, curve: elliptic.P521()},
+}
+
+// JWTConfig configures the validation of JWTs from an identity provider
+type JWTConfig struct {
+	JWKS     string        //path or http(s) URL of the provider's JWKS
+	Refresh  time.Duration //how long keys are cached before being refetched
+	Issuer   string        //required iss claim
+	Audience string        //required aud claim, or one of them
+
+	//RoleClaim names the claim holding the caller's role, as a string or
+	//array of strings. Values are looked up in RoleMap, or taken as role names
+	//if RoleMap is nil. If several values map to roles, the greatest is used
+	RoleClaim string
+	RoleMap   map[string]Role
+}
+
+// JWTAuthenticator accepts JWTs sent as Authorization: Bearer tokens,
+// verified offline against the provider's published keys
+type JWTAuthenticator struct {
+	config JWTConfig
+	keys   *keySet
+}
+
+// InitJWTAuthenticator loads the JWKS named in config, failing if it cannot
+// be read, so that a misconfigured provider is noticed at startup
+func InitJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("JWT validation requires an issuer and audience")
+	}
+	if config.RoleClaim == "" {
+		return nil, errors.New("JWT validation requires a role claim")
+	}
+	if config.Refresh <= 0 {
+		config.Refresh = time.Hour
+	}
+	keys, err := newKeySet(config.JWKS, config.Refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTAuthenticator{config: config, keys: keys}, nil
+}
+
+// ParseRoleMap reads a role map given as value=role pairs separated by commas
+func ParseRoleMap(raw string) (map[string]Role, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	roles := make(map[string]Role)
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("Malformed role mapping " + pair + ", expected value=role")
+		}
+		role, err := parseRole(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		roles[parts[0]] = role
+	}
+	return roles, nil
+}
+
+// Reload refetches the provider's keys
+func (j *JWTAuthenticator) Reload() error {
+	return j.keys.Reload()
+}
+
+func (j *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.verify(token, time.Now())
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	role, ok := j.role(claims)
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	return &Principal{Name: claims.Subject, Role: role}, nil
+}
+
+func (j *JWTAuthenticator) Challenge() string {
+	return `Bearer realm="` + j.config.Issuer + `"`
+}
+
+// jwtHeader is the JOSE header of a JWS
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the registered claims we check, and the rest by name
+type jwtClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	Expires   int64
+	NotBefore int64
+	raw       map[string]json.RawMessage
+}
+
+// verify checks the token's signature and its issuer, audience and validity period
+func (j *JWTAuthenticator) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, errors.New("unsupported algorithm " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	verified := false
+	for _, k := range j.keys.lookup(header.Kid, header.Alg) {
+		if verifySignature(k.key, alg, digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != j.config.Issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	audienceOK := false
+	for _, aud := range claims.Audience {
+		if aud == j.config.Audience {
+			audienceOK = true
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("wrong audience")
+	}
+	if claims.Expires == 0 || now.Add(-jwtLeeway).Unix() >= claims.Expires {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Unix() < claims.NotBefore {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+// verifySignature checks a signature by key, which must be of the kind alg
+// signs with, and for ECDSA on exactly its curve
+func verifySignature(key interface{}, alg jwtAlgorithm, digest, signature []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return alg.curve == nil && rsa.VerifyPKCS1v15(pub, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		if alg.curve == nil || pub.Curve.Params().Name != alg.curve.Params().Name {
+			return false
+		}
+		//JWS carries r and s as fixed size big-endian integers, not ASN.1
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func parseClaims(segment string) (*jwtClaims, error) {
+	claims := &jwtClaims{}
+	if err := decodeSegment(segment, &claims.raw); err != nil {
+		return nil, err
+	}
+	fields := []struct {
+		name string
+		v    interface{}
+	}{
+		{"iss", &claims.Issuer},
+		{"sub", &claims.Subject},
+		{"exp", &claims.Expires},
+		{"nbf", &claims.NotBefore},
+	}
+	for _, f := range fields {
+		if raw, ok := claims.raw[f.name]; ok {
+			if err := json.Unmarshal(raw, f.v); err != nil {
+				return nil, errors.New("malformed " + f.name + " claim")
+			}
+		}
+	}
+	aud, err := stringsClaim(claims.raw["aud"])
+	if err != nil {
+		return nil, errors.New("malformed aud claim")
+	}
+	claims.Audience = aud
+	return claims, nil
+}
+
+// stringsClaim reads a claim which may be a single string or an array of them
+func stringsClaim(raw json.RawMessage) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return []string{one}, nil
+	}
+	var many []string
+	err := json.Unmarshal(raw, &many)
+	return many, err
+}
+
+// role maps the token's role claim to the greatest role it names
+func (j *JWTAuthenticator) role(claims *jwtClaims) (Role, bool) {
+	values, err := stringsClaim(claims.raw[j.config.RoleClaim])
+	if err != nil {
+		return "", false
+	}
+	var best Role
+	for _, value := range values {
+		var role Role
+		if j.config.RoleMap != nil {
+			role = j.config.RoleMap[value]
+		} else {
+			role, _ = parseRole(value)
+		}
+		if role != "" && len(rolePermissions[role]) > len(rolePermissions[best]) {
+			best = role
+		}
+	}
+	return best, best != ""
+}
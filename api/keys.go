@@ -0,0 +1,222 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+// API keys are sent as bk_<id>_<secret>, the id locating the stored hash
+const (
+	apiKeyPrefix      = "bk_"
+	apiKeyIDBytes     = 8
+	apiKeySecretBytes = 32
+)
+
+// keyAuthenticator accepts API keys sent as Authorization: Bearer tokens
+// tokens without the API key prefix are left for later strategies
+type keyAuthenticator struct {
+	mdb *db.MessageDB
+}
+
+func (k *keyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, ErrNoCredentials
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, ErrBadCredentials
+	}
+	key, err := k.mdb.FetchAPIKey(parts[0])
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], key.Hash) != 1 || !key.Active(time.Now().Unix()) {
+		return nil, ErrBadCredentials
+	}
+
+	scopes := make([]Permission, 0, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		scopes = append(scopes, Permission(scope))
+	}
+	return &Principal{Name: "key:" + key.ID, Scopes: scopes}, nil
+}
+
+func (k *keyAuthenticator) Challenge() string {
+	return `Bearer realm="API key"`
+}
+
+// generateAPIKey creates a key with a random ID and secret, returning it
+// along with the token which the client must send
+func generateAPIKey(name string, scopes []string, expires int64) (*types.APIKey, string, error) {
+	ID := make([]byte, apiKeyIDBytes)
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(ID); err != nil {
+		return nil, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encodedSecret))
+	key := &types.APIKey{
+		ID:      hex.EncodeToString(ID),
+		Name:    name,
+		Hash:    hash[:],
+		Scopes:  scopes,
+		Created: time.Now().Unix(),
+		Expires: expires,
+	}
+	return key, apiKeyPrefix + key.ID + "_" + encodedSecret, nil
+}
+
+// createKeyRequest is the body of a create key request
+type createKeyRequest struct {
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Expires string   `json:"expires"` //RFC3339 or unix seconds, optional
+}
+
+// keyResponse describes an API key. Key holds the token, and is only
+// set in the response to the request which created it
+type keyResponse struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+	Created string   `json:"created"`
+	Expires string   `json:"expires,omitempty"`
+	Revoked string   `json:"revoked,omitempty"`
+	Key     string   `json:"key,omitempty"`
+}
+
+func newKeyResponse(key *types.APIKey) keyResponse {
+	format := func(t int64) string {
+		if t == 0 {
+			return ""
+		}
+		return time.Unix(t, 0).UTC().Format(time.RFC3339)
+	}
+	return keyResponse{
+		ID:      key.ID,
+		Name:    key.Name,
+		Scopes:  key.Scopes,
+		Created: format(key.Created),
+		Expires: format(key.Expires),
+		Revoked: format(key.Revoked),
+	}
+}
+
+// createKeyHandler handles a create API key request
+// it takes a name, a list of scopes (read, write and delete) and an optional expiry
+// it returns 201 with the key, whose token is never shown again
+func (a *API) createKeyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req createKeyRequest
+		if err := decodeJSON(r, &req, true); err != nil {
+			bodyErrorHandler(w, "createKey", err)
+			return
+		}
+		if req.Name == "" {
+			queryErrorHandler(w, "createKey", "name", errors.New("name is required"))
+			return
+		}
+		if len(req.Scopes) == 0 {
+			queryErrorHandler(w, "createKey", "scopes", errors.New("at least one scope is required"))
+			return
+		}
+		for _, scope := range req.Scopes {
+			if _, err := parseScope(scope); err != nil {
+				queryErrorHandler(w, "createKey", "scopes", err)
+				return
+			}
+		}
+		var expires int64
+		if req.Expires != "" {
+			var err error
+			expires, err = parseTimestamp(req.Expires)
+			if err != nil {
+				queryErrorHandler(w, "createKey", "expires", err)
+				return
+			}
+			if expires <= time.Now().Unix() {
+				queryErrorHandler(w, "createKey", "expires", errors.New("expires must be in the future"))
+				return
+			}
+		}
+
+		key, token, err := generateAPIKey(req.Name, req.Scopes, expires)
+		if err != nil {
+			internalErrorHandler(w, "createKey", err)
+			return
+		}
+		if err := a.mdb.InsertAPIKey(key); err != nil {
+			internalErrorHandler(w, "createKey", err)
+			return
+		}
+
+		response := newKeyResponse(key)
+		response.Key = token
+		responseJSON, err := json.MarshalIndent(response, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "createKey", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(responseJSON)
+	}
+}
+
+// getKeysHandler handles a list API keys request
+// it returns every key, including revoked and expired ones, without their tokens
+func (a *API) getKeysHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := a.mdb.FetchAPIKeys()
+		if err != nil {
+			internalErrorHandler(w, "getKeys", err)
+			return
+		}
+		response := []keyResponse{}
+		for _, key := range keys {
+			response = append(response, newKeyResponse(key))
+		}
+		responseJSON, err := json.MarshalIndent(response, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getKeys", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
+
+// revokeKeyHandler handles a revoke API key request
+// it takes the key ID from the path, and returns 404 if there is no such active key
+func (a *API) revokeKeyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		err := a.mdb.RevokeAPIKey(ID, time.Now().Unix())
+		if err == db.ErrKeyNotFound {
+			notFoundHandler(w, ID, "revokeKey")
+			return
+		}
+		if err != nil {
+			internalErrorHandler(w, "revokeKey", err)
+			return
+		}
+		w.Write([]byte{})
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/moderation"
+	"github.com/imw-challenge/back/types"
+)
+
+// SetModeration sets the filters new public messages pass through, training
+// them on the messages admins have already approved or rejected. It should be
+// called before the API starts serving. A nil pipeline accepts every message
+func (a *API) SetModeration(pipeline *moderation.Pipeline) error {
+	if pipeline != nil {
+		reviews, err := a.mdb.FetchReviews()
+		if err != nil {
+			return err
+		}
+		for _, review := range reviews {
+			if review.Decision != "" {
+				pipeline.Train(review.Message, review.Decision == types.ReviewRejected)
+			}
+		}
+	}
+	a.moderation = pipeline
+	return nil
+}
+
+func (a *API) moderate(message *types.Message) moderation.Verdict {
+	if a.moderation == nil {
+		return moderation.Verdict{}
+	}
+	return a.moderation.Check(message)
+}
+
+// holdMessage answers a post of a message quarantined by moderation, holding
+// it for review. Held messages are answered with 202, as they are not yet
+// stored, and reposts of them likewise
+func (a *API) holdMessage(w http.ResponseWriter, message *types.Message, reasons []string) {
+	review, _, err := a.mdb.HoldMessage(message, reasons)
+	switch err {
+	case nil:
+		writeMessage(w, "postMessage", http.StatusAccepted, review.Message)
+	case db.ErrStored:
+		stored, err := a.mdb.FetchByID(message.ID)
+		if err != nil {
+			internalErrorHandler(w, "postMessage", err)
+			return
+		}
+		w.Header().Set("ETag", etag(stored))
+		writeMessage(w, "postMessage", http.StatusOK, stored)
+	case db.ErrConflict:
+		writeProblem(w, http.StatusConflict, "A different message with ID "+message.ID+" already exists", nil)
+	default:
+		internalErrorHandler(w, "postMessage", err)
+	}
+}
+
+// reviewResponse is the JSON form of a review
+type reviewResponse struct {
+	ID        string         `json:"id"`
+	Message   *types.Message `json:"message"`
+	Reasons   []string       `json:"reasons"`
+	Held      string         `json:"held"`
+	Decision  string         `json:"decision"`
+	Decided   string         `json:"decided,omitempty"`
+	DecidedBy string         `json:"decided_by,omitempty"`
+}
+
+func newReviewResponse(review *types.Review) reviewResponse {
+	response := reviewResponse{
+		ID:        review.ID,
+		Message:   review.Message,
+		Reasons:   review.Reasons,
+		Held:      time.Unix(review.Held, 0).UTC().Format(time.RFC3339),
+		Decision:  review.Decision,
+		DecidedBy: review.DecidedBy,
+	}
+	if response.Decision == "" {
+		response.Decision = "pending"
+	}
+	if review.Decided != 0 {
+		response.Decided = time.Unix(review.Decided, 0).UTC().Format(time.RFC3339)
+	}
+	if response.Reasons == nil {
+		response.Reasons = []string{}
+	}
+	return response
+}
+
+func writeReview(w http.ResponseWriter, handlerID string, review *types.Review) {
+	responseJSON, err := json.MarshalIndent(newReviewResponse(review), "", "    ")
+	if err != nil {
+		internalErrorHandler(w, handlerID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// getReviewsHandler handles a list held messages request
+// it takes an optional decision, one of pending (the default), approved,
+// rejected or all, and returns the matching reviews in the order the
+// messages were held
+func (a *API) getReviewsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decision := r.URL.Query().Get("decision")
+		switch decision {
+		case "", "pending":
+			decision = ""
+		case types.ReviewApproved, types.ReviewRejected, "all":
+		default:
+			queryErrorHandler(w, "getReviews", "decision", errors.New("decision must be pending, approved, rejected or all"))
+			return
+		}
+		reviews, err := a.mdb.FetchReviews()
+		if err != nil {
+			internalErrorHandler(w, "getReviews", err)
+			return
+		}
+		response := []reviewResponse{}
+		for _, review := range reviews {
+			if decision == "all" || review.Decision == decision {
+				response = append(response, newReviewResponse(review))
+			}
+		}
+		responseJSON, err := json.MarshalIndent(response, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getReviews", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
+
+// getReviewHandler handles a get held message request
+// it takes the message ID from the path, and returns its review, or 404 if
+// no such message was held
+func (a *API) getReviewHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		review, err := a.mdb.FetchReview(ID)
+		if err == db.ErrReviewNotFound {
+			notFoundHandler(w, ID, "getReview")
+			return
+		}
+		if err != nil {
+			internalErrorHandler(w, "getReview", err)
+			return
+		}
+		writeReview(w, "getReview", review)
+	}
+}
+
+// approveReviewHandler handles an approve held message request
+// it takes the message ID from the path, stores the message, and returns 201
+// with the message as stored and its location
+// it returns 404 if no such message was held, and 409 if it was already
+// decided, or a message with its ID has been stored since
+func (a *API) approveReviewHandler() http.HandlerFunc {
+	return a.decideReviewHandler("approveReview", true)
+}
+
+// rejectReviewHandler handles a reject held message request
+// it takes the message ID from the path, and returns the decided review
+// it returns 404 if no such message was held, and 409 if it was already decided
+func (a *API) rejectReviewHandler() http.HandlerFunc {
+	return a.decideReviewHandler("rejectReview", false)
+}
+
+// decideReviewHandler approves or rejects a held message, training the
+// moderation filters on the decision
+func (a *API) decideReviewHandler(handlerID string, approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		var by string
+		if p := PrincipalFrom(r); p != nil {
+			by = p.Name
+		}
+		review, stored, err := a.dbFor(r).DecideReview(ID, approve, by)
+		switch err {
+		case nil:
+		case db.ErrReviewNotFound:
+			notFoundHandler(w, ID, handlerID)
+			return
+		case db.ErrDecided:
+			writeProblem(w, http.StatusConflict, ID+" was already decided", nil)
+			return
+		case db.ErrConflict:
+			writeProblem(w, http.StatusConflict, "A message with ID "+ID+" has been stored since it was held", nil)
+			return
+		default:
+			internalErrorHandler(w, handlerID, err)
+			return
+		}
+		if a.moderation != nil {
+			a.moderation.Train(review.Message, !approve)
+		}
+
+		if !approve {
+			writeReview(w, handlerID, review)
+			return
+		}
+		w.Header().Set("Location", "/private/messages/"+stored.ID)
+		w.Header().Set("ETag", etag(stored))
+		writeMessage(w, handlerID, http.StatusCreated, stored)
+	}
+}
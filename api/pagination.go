@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageFunc fetches up to limit messages, strictly past the cursor if it is not nil
+type pageFunc func(after *db.Cursor, limit int) ([]*types.Message, error)
+
+// messagePage is the body of a paginated message listing
+type messagePage struct {
+	Messages   []*types.Message `json:"messages"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor makes an opaque cursor token from the position of a message
+func encodeCursor(m *types.Message) string {
+	raw := strconv.FormatInt(m.Time, 10) + "|" + m.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(token string) (*db.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("Malformed cursor")
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed cursor")
+	}
+	messageTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("Malformed cursor")
+	}
+	return &db.Cursor{Time: messageTime, ID: parts[1]}, nil
+}
+
+// parseLimit reads the limit query parameter, returning def if it is absent
+func parseLimit(query url.Values, def int) (int, error) {
+	raw := query.Get("limit")
+	if raw == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, nil
+}
+
+// parseTimestamp reads a time given as RFC3339 or as unix seconds
+func parseTimestamp(raw string) (int64, error) {
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return seconds, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, errors.New("time must be RFC3339 or unix seconds")
+	}
+	return t.Unix(), nil
+}
+
+// parseOrder reads the order query parameter, which is desc unless given as asc
+func parseOrder(query url.Values) (bool, error) {
+	switch query.Get("order") {
+	case "asc":
+		return true, nil
+	case "", "desc":
+		return false, nil
+	}
+	return false, errors.New("order must be asc or desc")
+}
+
+// parseStatus reads the optional status query parameter, which is empty if absent
+func parseStatus(query url.Values) (string, error) {
+	status := query.Get("status")
+	if status != "" && !types.ValidStatus(status) {
+		return "", errStatus
+	}
+	return status, nil
+}
+
+// parseTimeRange reads the optional from and to query parameters, defaulting
+// to all time. On error it also returns the name of the offending parameter
+func parseTimeRange(query url.Values) (int64, int64, string, error) {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		start, err = parseTimestamp(raw)
+		if err != nil {
+			return 0, 0, "from", err
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		end, err = parseTimestamp(raw)
+		if err != nil {
+			return 0, 0, "to", err
+		}
+	}
+	if start > end {
+		return 0, 0, "from", errors.New("from must not be after to")
+	}
+	return start, end, "", nil
+}
+
+// setNextLink sets an RFC 5988 Link header pointing at the next page,
+// keeping every query parameter of the current request except the cursor
+func setNextLink(w http.ResponseWriter, r *http.Request, cursor string) {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchFunc transforms the JSON document of a message
+type patchFunc func(doc interface{}) (interface{}, error)
+
+// patchConflict is a JSON Patch operation which could not be applied
+type patchConflict struct {
+	err error
+}
+
+func (e *patchConflict) Error() string {
+	return e.err.Error()
+}
+
+func conflict(format string, args ...interface{}) error {
+	return &patchConflict{fmt.Errorf(format, args...)}
+}
+
+// patchMessageHandler handles a patch message request
+// it takes the message ID from the path, and a JSON Merge Patch (RFC 7396) or
+// JSON Patch (RFC 6902) body, chosen by the Content-Type, over the message's
+// id, name, email, text and time. The patched message is checked and stored
+// as a new version, in the same transaction as it is read
+// it returns the message as stored, 404 if there is no such message, 415 for
+// other content types, 400 for a malformed patch, 409 if an operation cannot
+// be applied, 422 if the result is not a valid message, and 412 if an
+// If-Match header no longer matches
+func (a *API) patchMessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		var patch patchFunc
+		var err error
+		switch mediaType {
+		case mergePatchType:
+			patch, err = parseMergePatch(r)
+		case jsonPatchType:
+			patch, err = parseJSONPatch(r)
+		default:
+			w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+			writeProblem(w, http.StatusUnsupportedMediaType, "Patches must be sent as "+mergePatchType+" or "+jsonPatchType, nil)
+			return
+		}
+		if err != nil {
+			bodyErrorHandler(w, "patchMessage", err)
+			return
+		}
+
+		updated, err := a.dbFor(r).UpdateMessage(ID, ifMatch(r), func(message *types.Message) error {
+			return patchMessage(message, patch)
+		})
+		switch e := err.(type) {
+		case nil:
+		case *patchConflict:
+			writeProblem(w, http.StatusConflict, e.Error(), nil)
+			return
+		case validationError:
+			writeProblem(w, http.StatusUnprocessableEntity, "The patched message has invalid fields", e)
+			return
+		default:
+			switch err {
+			case db.ErrNotFound:
+				notFoundHandler(w, ID, "patchMessage")
+			case db.ErrPreconditionFailed:
+				preconditionFailedHandler(w, "patchMessage")
+			default:
+				internalErrorHandler(w, "patchMessage", err)
+			}
+			return
+		}
+		w.Header().Set("ETag", etag(updated))
+		writeMessage(w, "patchMessage", http.StatusOK, updated)
+	}
+}
+
+// patchMessage applies patch to the JSON document of a message, and reads the
+// message back from the result, checking every field as for a new message
+func patchMessage(message *types.Message, patch patchFunc) error {
+	location := time.FixedZone("", message.TZ)
+	doc := map[string]interface{}{
+		"id":    message.ID,
+		"name":  message.Name,
+		"email": message.Email,
+		"text":  message.Text,
+		"time":  time.Unix(message.Time, 0).In(location).Format(time.RFC3339),
+	}
+	result, err := patch(doc)
+	if err != nil {
+		return err
+	}
+	patched, ok := result.(map[string]interface{})
+	if !ok {
+		return validationError{{"", "the patched message must be an object"}}
+	}
+
+	//the ID is checked here rather than as a new one would be, so that
+	//messages stored before IDs had to be UUIDs can still be patched
+	if ID, ok := patched["id"]; ok {
+		if ID != message.ID {
+			return validationError{{"id", "cannot be changed"}}
+		}
+		delete(patched, "id")
+	}
+	raw, err := json.Marshal(patched)
+	if err != nil {
+		return err
+	}
+	var updated types.Message
+	if err := decodeMessage(raw, &updated, editableFields, "text", "time"); err != nil {
+		return err
+	}
+	message.Name = updated.Name
+	message.Email = updated.Email
+	message.Text = updated.Text
+	message.Time = updated.Time
+	message.TZ = updated.TZ
+	return nil
+}
+
+// parseMergePatch reads a JSON Merge Patch, as in RFC 7396
+func parseMergePatch(r *http.Request) (patchFunc, error) {
+	var patch interface{}
+	if err := decodeJSON(r, &patch, false); err != nil {
+		return nil, err
+	}
+	return func(doc interface{}) (interface{}, error) {
+		return mergePatch(doc, patch), nil
+	}, nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	result, ok := target.(map[string]interface{})
+	if !ok {
+		result = map[string]interface{}{}
+	}
+	for key, value := range members {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergePatch(result[key], value)
+		}
+	}
+	return result
+}
+
+// patchOp is one operation of a JSON Patch. Value is kept raw so that
+// an explicit null can be told apart from a missing value
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// parseJSONPatch reads a JSON Patch, as in RFC 6902, checking that each
+// operation is well formed before any is applied
+func parseJSONPatch(r *http.Request) (patchFunc, error) {
+	//not strict, as members an operation does not define must be ignored
+	var ops []patchOp
+	if err := decodeJSON(r, &ops, false); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(ops))
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, fmt.Errorf("operation %d has no path", i)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d has no value", i)
+			}
+			if err := json.Unmarshal(op.Value, &values[i]); err != nil {
+				return nil, err
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return nil, fmt.Errorf("operation %d has no from", i)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d has unknown op %q", i, op.Op)
+		}
+	}
+
+	return func(doc interface{}) (interface{}, error) {
+		for i, op := range ops {
+			var err error
+			if doc, err = applyOp(doc, op, values[i]); err != nil {
+				return nil, conflict("operation %d (%s %s): %s", i, op.Op, *op.Path, err)
+			}
+		}
+		return doc, nil
+	}, nil
+}
+
+func applyOp(doc interface{}, op patchOp, value interface{}) (interface{}, error) {
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err = pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		//the whole document can be replaced, though not removed
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, _, err = pointerRemove(doc, path); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "test":
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+
+	from, err := parsePointer(*op.From)
+	if err != nil {
+		return nil, err
+	}
+	if op.Op == "move" {
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.New("cannot move a value into itself")
+		}
+		var moved interface{}
+		if doc, moved, err = pointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, moved)
+	}
+	copied, err := pointerGet(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	//copy through JSON so the two values share nothing
+	raw, _ := json.Marshal(copied)
+	json.Unmarshal(raw, &copied)
+	return pointerAdd(doc, path, copied)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, errors.New("path must start with /")
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex reads an array index token, allowing "-" (one past the end) if
+// end is true. The index must be within the array, or at its end if end is true
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, errors.New("invalid array index " + token)
+	}
+	if i > length || (i == length && !end) {
+		return 0, errors.New("array index out of range " + token)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.New("no member " + token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, errors.New("cannot index into a scalar")
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd adds value at path, returning the new document, as the
+// containing array may be replaced
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			node[token] = value
+			return node, nil
+		}
+		child, ok := node[token]
+		if !ok {
+			return nil, errors.New("no member " + token)
+		}
+		child, err := pointerAdd(child, path[1:], value)
+		node[token] = child
+		return node, err
+	case []interface{}:
+		if len(path) == 1 {
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerAdd(node[i], path[1:], value)
+		node[i] = child
+		return node, err
+	}
+	return nil, errors.New("cannot add to a scalar")
+}
+
+// pointerRemove removes the value at path, returning the new document and
+// the value removed
+func pointerRemove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	token := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[token]
+		if !ok {
+			return nil, nil, errors.New("no member " + token)
+		}
+		if len(path) == 1 {
+			delete(node, token)
+			return node, child, nil
+		}
+		child, removed, err := pointerRemove(child, path[1:])
+		node[token] = child
+		return node, removed, err
+	case []interface{}:
+		i, err := arrayIndex(token, len(node), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := node[i]
+			return append(node[:i], node[i+1:]...), removed, nil
+		}
+		child, removed, err := pointerRemove(node[i], path[1:])
+		node[i] = child
+		return node, removed, err
+	}
+	return nil, nil, errors.New("cannot remove from a scalar")
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const problemType = "application/problem+json"
+
+// problem is the body of an error response, as in RFC 7807
+type problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	InvalidParams []invalidParam `json:"invalid-params,omitempty"`
+}
+
+// invalidParam is a field or parameter of a request which failed validation,
+// as in the invalid-params extension of RFC 7807
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// validationError lists every invalid field of a request
+type validationError []invalidParam
+
+func (v validationError) Error() string {
+	if len(v) == 0 {
+		return "invalid request"
+	}
+	return v[0].Name + ": " + v[0].Reason
+}
+
+// writeProblem writes an RFC 7807 problem with the given status. The title
+// is the status text, as the problems are not otherwise typed
+func writeProblem(w http.ResponseWriter, status int, detail string, params []invalidParam) {
+	body, _ := json.MarshalIndent(&problem{
+		Type:          "about:blank",
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        detail,
+		InvalidParams: params,
+	}, "", "    ")
+	w.Header().Set("Content-Type", problemType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//idle client buckets are swept this often, once they would be full again
+	rateLimitSweep = time.Minute
+
+	//the most clients tracked at once, past which new clients are refused
+	//until the next sweep, so that the limiter cannot itself exhaust memory
+	maxRateLimitClients = 100000
+)
+
+// RateLimit is a token bucket, refilled with Rate tokens a second up to Burst.
+// Each request takes a token. A zero Rate is no limit
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig limits requests to the public routes, from each client and in total
+type RateLimitConfig struct {
+	PerClient RateLimit
+	Global    RateLimit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	return &bucket{tokens: float64(limit.Burst), last: now}
+}
+
+// refill adds the tokens earned since the bucket was last used
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// wait returns how long until the bucket holds a token, or zero if it does now
+func (b *bucket) wait(limit RateLimit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// rateLimiter keeps a token bucket for each client, and one shared by all
+type rateLimiter struct {
+	mu      sync.Mutex
+	config  RateLimitConfig
+	global  *bucket
+	clients map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(config RateLimitConfig, now time.Time) *rateLimiter {
+	for _, limit := range []*RateLimit{&config.PerClient, &config.Global} {
+		if limit.Rate > 0 && limit.Burst < 1 {
+			limit.Burst = 1
+		}
+	}
+	return &rateLimiter{
+		config:  config,
+		global:  newBucket(config.Global, now),
+		clients: make(map[string]*bucket),
+		swept:   now,
+	}
+}
+
+// allow takes a token for a request from client, if both the client's bucket
+// and the global one hold one. Otherwise it takes nothing, and returns how
+// long until the request would be allowed
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= rateLimitSweep {
+		l.sweep(now)
+	}
+
+	var wait time.Duration
+	var clientBucket *bucket
+	if l.config.PerClient.Rate > 0 {
+		clientBucket = l.clients[client]
+		if clientBucket == nil {
+			if len(l.clients) >= maxRateLimitClients {
+				return false, l.swept.Add(rateLimitSweep).Sub(now)
+			}
+			clientBucket = newBucket(l.config.PerClient, now)
+			l.clients[client] = clientBucket
+		}
+		clientBucket.refill(l.config.PerClient, now)
+		wait = clientBucket.wait(l.config.PerClient)
+	}
+	if l.config.Global.Rate > 0 {
+		l.global.refill(l.config.Global, now)
+		if globalWait := l.global.wait(l.config.Global); globalWait > wait {
+			wait = globalWait
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	if clientBucket != nil {
+		clientBucket.tokens--
+	}
+	if l.config.Global.Rate > 0 {
+		l.global.tokens--
+	}
+	return true, 0
+}
+
+// sweep forgets the clients whose buckets have refilled, as new buckets start
+// full anyway. Call with mu held
+func (l *rateLimiter) sweep(now time.Time) {
+	limit := l.config.PerClient
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
+
+// SetRateLimit limits requests to the public routes. It should be called
+// before the API starts serving
+func (a *API) SetRateLimit(config RateLimitConfig) {
+	a.limiter = newRateLimiter(config, time.Now())
+}
+
+// SetMaxStoredBytes caps the size of the stored messages, past which new
+// messages are refused with 503. Zero is no cap
+func (a *API) SetMaxStoredBytes(max int64) {
+	a.maxStoredBytes = max
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For headers are
+// believed when working out the address of a client
+func (a *API) SetTrustedProxies(proxies []*net.IPNet) {
+	a.trustedProxies = proxies
+}
+
+// ParseTrustedProxies reads a list of proxy addresses, as IPs or CIDR
+// ranges, separated by commas
+func ParseTrustedProxies(raw string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("Invalid proxy address " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("Invalid proxy range " + entry)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (a *API) trusted(ip net.IP) bool {
+	for _, proxy := range a.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address the request came from. If it came through
+// trusted proxies, X-Forwarded-For is read from the right, and the first
+// address not of a trusted proxy is the client's; addresses further left
+// could have been sent by the client, so are never believed
+func (a *API) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !a.trusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !a.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// rateLimitKey is the bucket a client's requests are counted in. IPv6
+// clients are counted by /64, as a single host is usually given a whole one
+func rateLimitKey(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() != nil {
+		return client
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// rateLimited wraps a public handler, refusing requests with 429 while their
+// client or all clients together are over the rate limit
+func (a *API) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.limiter != nil {
+			ok, wait := a.limiter.allow(rateLimitKey(a.clientIP(r)), time.Now())
+			if !ok {
+				retry := int(math.Ceil(wait.Seconds()))
+				if retry < 1 {
+					retry = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(retry))
+				writeProblem(w, http.StatusTooManyRequests, "Too many requests, retry after "+strconv.Itoa(retry)+" seconds", nil)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+// revisionsResponse is the body of a revision listing
+type revisionsResponse struct {
+	Revisions []*types.Message `json:"revisions"`
+}
+
+// parseVersion reads the revision number from the path
+func parseVersion(r *http.Request) (int, error) {
+	version, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || version < 1 {
+		return 0, errors.New("revision must be a positive integer")
+	}
+	return version, nil
+}
+
+// writeMessage writes a single message as pretty-printed JSON, with status
+func writeMessage(w http.ResponseWriter, handlerID string, status int, message *types.Message) {
+	messageJSON, err := json.MarshalIndent(message, "", "    ")
+	if err != nil {
+		internalErrorHandler(w, handlerID, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(messageJSON)
+}
+
+// getRevisionsHandler handles a request for the history of a message
+// it takes the message ID from the path, and returns every version of it,
+// oldest first, or 404 if there is no such message
+func (a *API) getRevisionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		revisions, err := a.mdb.FetchRevisions(ID)
+		if err == db.ErrNotFound {
+			notFoundHandler(w, ID, "getRevisions")
+			return
+		}
+		if err != nil {
+			internalErrorHandler(w, "getRevisions", err)
+			return
+		}
+
+		responseJSON, err := json.MarshalIndent(&revisionsResponse{Revisions: revisions}, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "getRevisions", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
+
+// getRevisionHandler handles a request for one version of a message
+// it takes the message ID and revision number from the path, and returns
+// 404 if there is no such message or revision
+func (a *API) getRevisionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		version, err := parseVersion(r)
+		if err != nil {
+			queryErrorHandler(w, "getRevision", "n", err)
+			return
+		}
+		revision, err := a.mdb.FetchRevision(ID, version)
+		if err == db.ErrNotFound || err == db.ErrRevisionNotFound {
+			notFoundHandler(w, ID, "getRevision")
+			return
+		}
+		if err != nil {
+			internalErrorHandler(w, "getRevision", err)
+			return
+		}
+		writeMessage(w, "getRevision", http.StatusOK, revision)
+	}
+}
+
+// rollbackHandler handles a request to roll a message back to an earlier version
+// it takes the message ID and revision number from the path, and stores that
+// revision's content as a new version, returning the message as stored
+// it returns 404 if there is no such message or revision
+func (a *API) rollbackHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		version, err := parseVersion(r)
+		if err != nil {
+			queryErrorHandler(w, "rollback", "n", err)
+			return
+		}
+		message, err := a.dbFor(r).RollbackMessage(ID, version)
+		if err == db.ErrNotFound || err == db.ErrRevisionNotFound {
+			notFoundHandler(w, ID, "rollback")
+			return
+		}
+		if err != nil {
+			internalErrorHandler(w, "rollback", err)
+			return
+		}
+		w.Header().Set("ETag", etag(message))
+		writeMessage(w, "rollback", http.StatusOK, message)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Role is the level of access granted to an authenticated user
+type Role string
+
+const (
+	RoleReader Role = "reader" //may read messages
+	RoleEditor Role = "editor" //may also update message text
+	RoleAdmin  Role = "admin"  //may also delete and restore messages, moderate, manage API keys and read the audit log
+)
+
+// Permission is what a private route requires of its caller
+type Permission string
+
+const (
+	PermRead   Permission = "read"
+	PermWrite  Permission = "write"
+	PermDelete Permission = "delete"
+	PermKeys   Permission = "keys" //create and revoke API keys, never granted to a key
+	PermAudit  Permission = "audit"
+
+	PermModerate Permission = "moderate" //approve or reject held public messages
+)
+
+// rolePermissions lists what each role may do
+var rolePermissions = map[Role][]Permission{
+	RoleReader: {PermRead},
+	RoleEditor: {PermRead, PermWrite},
+	RoleAdmin:  {PermRead, PermWrite, PermDelete, PermKeys, PermAudit, PermModerate},
+}
+
+// Principal is an authenticated caller of the API
+type Principal struct {
+	Name string
+	Role Role
+
+	//Scopes, if set, are granted in place of a role, as for API keys
+	Scopes []Permission
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	auditKey
+)
+
+// parseRole checks that a role name is one we know
+func parseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", errors.New("Unknown role " + name)
+	}
+	return role, nil
+}
+
+// Can reports whether the principal's role or scopes grant a permission
+func (p *Principal) Can(perm Permission) bool {
+	granted := rolePermissions[p.Role]
+	if p.Scopes != nil {
+		granted = p.Scopes
+	}
+	for _, granted := range granted {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScope checks that a scope names a permission an API key may hold
+func parseScope(name string) (Permission, error) {
+	switch perm := Permission(name); perm {
+	case PermRead, PermWrite, PermDelete, PermAudit, PermModerate:
+		return perm, nil
+	}
+	return "", errors.New("Unknown scope " + name)
+}
+
+// withPrincipal attaches the authenticated caller to a request
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey, p))
+}
+
+// PrincipalFrom returns the authenticated caller of a private route,
+// or nil on a public route
+func PrincipalFrom(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey).(*Principal)
+	return p
+}
+
+// requirePermission wraps an authenticated handler, answering 403 if the
+// caller's role or scopes do not grant perm
+func requirePermission(handler http.HandlerFunc, perm Permission) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFrom(r)
+		if p == nil || !p.Can(perm) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden.\n"))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/types"
+)
+
+// maxStatusIDs is how many messages a bulk status change may move at once
+const maxStatusIDs = 1000
+
+var errStatus = errors.New("status must be new, read, replied or archived")
+
+// statusRequest is the body of a status change request
+type statusRequest struct {
+	Status string `json:"status"`
+}
+
+// bulkStatusRequest is the body of a bulk status change request
+type bulkStatusRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+}
+
+// checkStatus checks the status a request asks for
+func checkStatus(w http.ResponseWriter, handlerID string, status string) bool {
+	if status == "" {
+		queryErrorHandler(w, handlerID, "status", errors.New("status is required"))
+		return false
+	}
+	if !types.ValidStatus(status) {
+		queryErrorHandler(w, handlerID, "status", errStatus)
+		return false
+	}
+	return true
+}
+
+// statusErrorHandler answers a status change which SetStatus refused
+func statusErrorHandler(w http.ResponseWriter, handlerID string, status string, err error) {
+	e, ok := err.(*db.StatusError)
+	if !ok {
+		internalErrorHandler(w, handlerID, err)
+		return
+	}
+	switch e.Err {
+	case db.ErrNotFound:
+		notFoundHandler(w, e.ID, handlerID)
+	case db.ErrPreconditionFailed:
+		preconditionFailedHandler(w, handlerID)
+	default:
+		writeProblem(w, http.StatusConflict, e.ID+" is "+e.From+", so cannot become "+status, nil)
+	}
+}
+
+// setStatusHandler handles a status change request
+// it takes the message ID from the path, and a body holding the status to move
+// the message to, and stores the moved message, keeping its version and ETag
+// it returns the message as stored, 404 if there is no such message, 409 if
+// the message cannot move from its status to that one, and 412 if an If-Match
+// header no longer matches
+func (a *API) setStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := mux.Vars(r)["id"]
+		var req statusRequest
+		if err := decodeJSON(r, &req, true); err != nil {
+			bodyErrorHandler(w, "setStatus", err)
+			return
+		}
+		if !checkStatus(w, "setStatus", req.Status) {
+			return
+		}
+
+		messages, err := a.dbFor(r).SetStatus([]string{ID}, req.Status, ifMatch(r))
+		if err != nil {
+			statusErrorHandler(w, "setStatus", req.Status, err)
+			return
+		}
+		w.Header().Set("ETag", etag(messages[0]))
+		writeMessage(w, "setStatus", http.StatusOK, messages[0])
+	}
+}
+
+// setStatusesHandler handles a bulk status change request
+// it takes a body holding the IDs of the messages and the status to move them
+// to, and moves them all together, or none of them
+// it returns the messages as stored, in the order of the IDs, 404 naming the
+// first message which does not exist, or 409 naming the first which cannot
+// move from its status to that one
+// a single ETag cannot name versions of several messages, so an If-Match
+// header is refused with 400 rather than ignored
+func (a *API) setStatusesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header["If-Match"]) > 0 {
+			writeProblem(w, http.StatusBadRequest, "If-Match is not supported when moving several messages, move them one at a time instead", nil)
+			return
+		}
+		var req bulkStatusRequest
+		if err := decodeJSON(r, &req, true); err != nil {
+			bodyErrorHandler(w, "setStatuses", err)
+			return
+		}
+		if len(req.IDs) == 0 {
+			queryErrorHandler(w, "setStatuses", "ids", errors.New("at least one ID is required"))
+			return
+		}
+		if len(req.IDs) > maxStatusIDs {
+			queryErrorHandler(w, "setStatuses", "ids", errors.New("at most "+strconv.Itoa(maxStatusIDs)+" messages may be moved at once"))
+			return
+		}
+		if !checkStatus(w, "setStatuses", req.Status) {
+			return
+		}
+
+		messages, err := a.dbFor(r).SetStatus(req.IDs, req.Status, nil)
+		if err != nil {
+			statusErrorHandler(w, "setStatuses", req.Status, err)
+			return
+		}
+		responseJSON, err := json.MarshalIndent(messagePage{Messages: messages}, "", "    ")
+		if err != nil {
+			internalErrorHandler(w, "setStatuses", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+	}
+}
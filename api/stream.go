@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/imw-challenge/back/types"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+// scanFunc feeds messages one at a time to fn, stopping at the first error
+type scanFunc func(fn func(*types.Message) error) error
+
+// acceptsNDJSON reports whether the Accept header prefers newline delimited
+// JSON. NDJSON is chosen when it is accepted with a quality above 0 which is at
+// least that of plain JSON, whether that is named or matched by a wildcard
+func acceptsNDJSON(r *http.Request) bool {
+	ndjson, plain := 0.0, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		switch mediaType {
+		case ndjsonType, "application/ndjson":
+			ndjson = math.Max(ndjson, q)
+		case "application/json", "application/*", "*/*":
+			plain = math.Max(plain, q)
+		}
+	}
+	return ndjson > 0 && ndjson >= plain
+}
+
+// streamMessages writes the messages produced by scan straight to w as they
+// are read, either as newline delimited JSON or as a pretty-printed JSON array,
+// depending on the Accept header. Nothing is buffered beyond a single message,
+// so once the first message is written, errors can only be logged
+func streamMessages(w http.ResponseWriter, r *http.Request, handlerID string, scan scanFunc) {
+	written := false
+	fail := func(err error) {
+		if written {
+			//too late to change the status, the client sees a truncated body
+			log.Printf("Internal error in %s after streaming began: %s", handlerID, err)
+			return
+		}
+		internalErrorHandler(w, handlerID, err)
+	}
+
+	if acceptsNDJSON(r) {
+		w.Header().Set("Content-Type", ndjsonType)
+		err := scan(func(m *types.Message) error {
+			line, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			written = true
+			_, err = w.Write(append(line, '\n'))
+			return err
+		})
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	first := true
+	err := scan(func(m *types.Message) error {
+		//indent each element as json.MarshalIndent would within the array
+		element, err := json.MarshalIndent(m, "    ", "    ")
+		if err != nil {
+			return err
+		}
+		separator := ",\n    "
+		if first {
+			separator = "[\n    "
+			first = false
+		}
+		written = true
+		_, err = w.Write(append([]byte(separator), element...))
+		return err
+	})
+	if err != nil {
+		fail(err)
+		return
+	}
+	if first {
+		w.Write([]byte("[]"))
+	} else {
+		w.Write([]byte("\n]"))
+	}
+}
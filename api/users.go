@@ -0,0 +1,156 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserStore holds the bcrypt password hashes and roles of the users allowed
+// to call private routes. It can be reloaded from its source while in use
+type UserStore struct {
+	mu     sync.RWMutex
+	users  map[string]*user
+	source func() (string, error)
+
+	//compared against when the username is unknown, so that unknown and
+	//known users take the same time to reject
+	dummyHash []byte
+}
+
+type user struct {
+	hash []byte
+	role Role
+}
+
+// LoadUserFile reads users from a file of username:hash:role lines. The role
+// may be left off, as in the output of htpasswd -B, in which case it is reader.
+// Blank lines and lines starting with # are ignored
+func LoadUserFile(path string) (*UserStore, error) {
+	return loadUsers(func() (string, error) {
+		data, err := ioutil.ReadFile(path)
+		return string(data), err
+	})
+}
+
+// LoadUserEnv reads users from an environment variable holding username:hash:role
+// entries separated by commas or newlines
+func LoadUserEnv(name string) (*UserStore, error) {
+	return loadUsers(func() (string, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("Environment variable " + name + " not set")
+		}
+		return strings.Replace(value, ",", "\n", -1), nil
+	})
+}
+
+// InitUserStore creates a store holding a single user, with the password
+// hashed at the given bcrypt cost
+func InitUserStore(username, password string, role Role, cost int) (*UserStore, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return nil, err
+	}
+	return loadUsers(func() (string, error) {
+		return username + ":" + string(hash) + ":" + string(role), nil
+	})
+}
+
+func loadUsers(source func() (string, error)) (*UserStore, error) {
+	s := &UserStore{source: source}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the users from the store's source. If the source cannot
+// be read or parsed, the users already loaded are kept
+func (s *UserStore) Reload() error {
+	raw, err := s.source()
+	if err != nil {
+		return err
+	}
+	users, err := parseUsers(raw)
+	if err != nil {
+		return err
+	}
+
+	//the dummy hash must cost as much as the dearest real one to hide misses
+	maxCost := bcrypt.MinCost
+	for _, u := range users {
+		if cost, _ := bcrypt.Cost(u.hash); cost > maxCost {
+			maxCost = cost
+		}
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("not a password"), maxCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.dummyHash = dummyHash
+	s.mu.Unlock()
+	return nil
+}
+
+// parseUsers parses username:hash:role lines, checking that each hash is
+// bcrypt and each role is known. Lines without a role, as htpasswd writes
+// them, are readers, so that no one is given more than reading by default
+func parseUsers(raw string) (map[string]*user, error) {
+	users := make(map[string]*user)
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, errors.New("Malformed user entry, expected username:hash:role")
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, errors.New("User " + parts[0] + " does not have a bcrypt hash")
+		}
+		role := RoleReader
+		if len(parts) == 3 {
+			var err error
+			if role, err = parseRole(parts[2]); err != nil {
+				return nil, err
+			}
+		}
+		users[parts[0]] = &user{hash: []byte(parts[1]), role: role}
+	}
+	if len(users) == 0 {
+		return nil, errors.New("No users configured")
+	}
+	return users, nil
+}
+
+// Authenticate returns the principal matching the username and password.
+// Every username is compared in constant time, and a hash is always checked,
+// so the time taken does not reveal which usernames exist
+func (s *UserStore) Authenticate(username, password string) (*Principal, bool) {
+	s.mu.RLock()
+	hash := s.dummyHash
+	var found *user
+	for name, u := range s.users {
+		if subtle.ConstantTimeCompare([]byte(name), []byte(username)) == 1 {
+			hash = u.hash
+			found = u
+		}
+	}
+	s.mu.RUnlock()
+
+	match := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	if found == nil || !match {
+		return nil, false
+	}
+	return &Principal{Name: username, Role: found.role}, true
+}
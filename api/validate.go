@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/imw-challenge/back/types"
+)
+
+const (
+	maxNameLength  = 256  //characters
+	maxEmailLength = 254  //bytes, as SMTP allows
+	maxTextLength  = 4096 //characters
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// messageFields are the fields a message body may hold. The bookkeeping
+// fields of a message read back from the API are allowed so that it can be
+// sent back as it is, but they are ignored
+var messageFields = map[string]bool{
+	"id": true, "name": true, "email": true, "text": true, "time": true,
+	"status": true, "version": true, "created_at": true, "updated_at": true,
+}
+
+// editableFields are the fields of a message a patch may touch
+var editableFields = map[string]bool{
+	"id": true, "name": true, "email": true, "text": true, "time": true,
+}
+
+// decodeMessage reads a message from a JSON object into message, checking
+// every field present against the rules of checkField, that no fields outside
+// allowed are given, and that the required fields are present. Fields left out
+// keep the values message already holds, so it can be filled with defaults.
+// It returns a validationError listing every invalid field, or the JSON error
+// if the body is not an object
+func decodeMessage(raw []byte, message *types.Message, allowed map[string]bool, required ...string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return err
+	}
+
+	var invalid validationError
+	for _, name := range required {
+		if _, ok := fields[name]; !ok {
+			invalid = append(invalid, invalidParam{name, "is required"})
+		}
+	}
+	for name, value := range fields {
+		if !allowed[name] {
+			invalid = append(invalid, invalidParam{name, "is not a known field"})
+			continue
+		}
+		if !editableFields[name] {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			invalid = append(invalid, invalidParam{name, "must be a string"})
+			continue
+		}
+		if reason := checkField(name, s); reason != "" {
+			invalid = append(invalid, invalidParam{name, reason})
+		}
+	}
+	if invalid != nil {
+		sort.Slice(invalid, func(i, j int) bool { return invalid[i].Name < invalid[j].Name })
+		return invalid
+	}
+	return json.Unmarshal(raw, message)
+}
+
+// checkField returns why the value of a message field is invalid, or ""
+func checkField(name, value string) string {
+	switch name {
+	case "id":
+		if !uuidPattern.MatchString(value) {
+			return "must be a UUID"
+		}
+	case "name":
+		if utf8.RuneCountInString(value) > maxNameLength {
+			return "must be at most " + strconv.Itoa(maxNameLength) + " characters"
+		}
+	case "email":
+		if value == "" {
+			return ""
+		}
+		if len(value) > maxEmailLength {
+			return "must be at most " + strconv.Itoa(maxEmailLength) + " bytes"
+		}
+		//a bare address only, not one with a display name or in angle brackets
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Address != value {
+			return "must be an email address"
+		}
+	case "text":
+		if value == "" {
+			return "must not be empty"
+		}
+		if utf8.RuneCountInString(value) > maxTextLength {
+			return "must be at most " + strconv.Itoa(maxTextLength) + " characters"
+		}
+	case "time":
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return "must be an RFC3339 time"
+		}
+	}
+	return ""
+}
+
+// readMessage reads a message from the request body into message, validated
+// as by decodeMessage against the fields of a message
+func readMessage(r *http.Request, message *types.Message, required ...string) error {
+	raw, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	return decodeMessage(raw, message, messageFields, required...)
+}
+
+// newMessageID generates a random (version 4) UUID for a message, in upper
+// case like the IDs of the original data
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	ID := strings.ToUpper(hex.EncodeToString(b[:]))
+	return ID[:8] + "-" + ID[8:12] + "-" + ID[12:16] + "-" + ID[16:20] + "-" + ID[20:]
+}
@@ -4,35 +4,245 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/imw-challenge/back/api"
 	"github.com/imw-challenge/back/db"
+	"github.com/imw-challenge/back/moderation"
+	"golang.org/x/crypto/bcrypt"
 )
 
+const usersEnv = "BACK_USERS"
+
 var (
 	dataPath  string
 	batchSize int
+	walPath   string
+
+	softDelete bool
+	usersPath  string
+
+	jwksSource   string
+	jwksRefresh  time.Duration
+	jwtIssuer    string
+	jwtAudience  string
+	jwtRoleClaim string
+	jwtRoleMap   string
+
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotRetain   int
+
+	idempotencyWindow time.Duration
+
+	rateLimit       float64
+	rateBurst       int
+	globalRateLimit float64
+	globalRateBurst int
+	trustedProxies  string
+	maxStoredBytes  int64
+
+	auditRetention  time.Duration
+	auditMaxEntries int
+
+	maxBody       int64
+	maxBodyRoutes string
+
+	blocklistPath   string
+	quarantineLinks int
+	rejectLinks     int
+	repeatWindow    time.Duration
+	repeatMax       int
+	spamQuarantine  float64
+	spamReject      float64
 )
 
 func main() {
 	flag.StringVar(&dataPath, "datapath", "./data.csv", "path to file containing csv message data")
 	flag.IntVar(&batchSize, "batchsize", 100, "maximum transaction batch size for adding messages to databse")
+	flag.StringVar(&walPath, "wal", "", "path to write-ahead log file, messages are not persisted if empty")
+	flag.StringVar(&snapshotDir, "snapshotdir", "", "directory for periodic database snapshots, snapshots are disabled if empty")
+	flag.DurationVar(&snapshotInterval, "snapshotinterval", 5*time.Minute, "time between database snapshots")
+	flag.IntVar(&snapshotRetain, "snapshotretain", 3, "number of snapshots to keep on disk")
+	flag.BoolVar(&softDelete, "softdelete", false, "keep deleted messages so they can be restored, instead of removing them")
+	flag.StringVar(&usersPath, "users", "", "path to file of username:bcrypt-hash:role lines for private routes, read from $"+usersEnv+" if empty")
+	flag.StringVar(&jwksSource, "jwks", "", "path or URL of an identity provider's JWKS, JWTs are not accepted if empty")
+	flag.DurationVar(&jwksRefresh, "jwksrefresh", time.Hour, "time before cached JWKS keys are refetched")
+	flag.StringVar(&jwtIssuer, "jwtissuer", "", "issuer JWTs must be from")
+	flag.StringVar(&jwtAudience, "jwtaudience", "", "audience JWTs must be for")
+	flag.StringVar(&jwtRoleClaim, "jwtroleclaim", "role", "JWT claim holding the caller's role")
+	flag.StringVar(&jwtRoleMap, "jwtrolemap", "", "comma separated value=role pairs mapping role claim values to roles, values are taken as role names if empty")
+	flag.DurationVar(&idempotencyWindow, "idempotencywindow", api.DefaultIdempotencyWindow, "time responses to requests with an Idempotency-Key are kept for replay")
+	flag.Float64Var(&rateLimit, "ratelimit", 1, "public posts allowed per second from each client, unlimited if 0")
+	flag.IntVar(&rateBurst, "rateburst", 10, "public posts allowed at once from each client")
+	flag.Float64Var(&globalRateLimit, "globalratelimit", 100, "public posts allowed per second from all clients together, unlimited if 0")
+	flag.IntVar(&globalRateBurst, "globalrateburst", 200, "public posts allowed at once from all clients together")
+	flag.StringVar(&trustedProxies, "trustedproxies", "", "comma separated IPs or CIDR ranges of proxies whose X-Forwarded-For headers are trusted")
+	flag.Int64Var(&maxStoredBytes, "maxstoredbytes", 1<<30, "approximate bytes of messages and audit entries stored before public posts are refused, unlimited if 0")
+	flag.DurationVar(&auditRetention, "auditretention", 90*24*time.Hour, "time audit entries are kept for, forever if 0")
+	flag.IntVar(&auditMaxEntries, "auditmaxentries", 1000000, "most audit entries kept, the oldest are dropped beyond it, unlimited if 0")
+	flag.Int64Var(&maxBody, "maxbody", api.DefaultBodyLimit, "most bytes a request body may hold, unlimited if 0")
+	flag.StringVar(&maxBodyRoutes, "maxbodyroutes", "", "comma separated path=bytes pairs overriding -maxbody for routes, by path template")
+	flag.StringVar(&blocklistPath, "blocklist", "", "path to file of words, phrases and /regexps/, one per line, public messages holding any of which are held for review")
+	flag.IntVar(&quarantineLinks, "quarantinelinks", 0, "links a public message may hold before it is held for review, unlimited if 0")
+	flag.IntVar(&rejectLinks, "rejectlinks", 0, "links a public message may hold before it is rejected, unlimited if 0")
+	flag.DurationVar(&repeatWindow, "repeatwindow", time.Hour, "time over which public messages with the same text are counted")
+	flag.IntVar(&repeatMax, "repeatmax", 0, "public messages with the same text allowed within -repeatwindow before more are held for review, unlimited if 0")
+	flag.Float64Var(&spamQuarantine, "spamquarantine", 0.9, "spam probability at which public messages are held for review, never if 0")
+	flag.Float64Var(&spamReject, "spamreject", 0.99, "spam probability at which public messages are rejected, never if 0")
 	flag.Parse()
 
 	mdb, err := db.InitMessageDB()
 	if err != nil {
 		log.Fatal(err)
 	}
+	mdb.SetSoftDelete(softDelete)
+	mdb.SetAuditRetention(auditRetention, auditMaxEntries)
+
+	//restore from the newest valid snapshot, or fall back to the csv data
+	loaded := false
+	if snapshotDir != "" {
+		if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		path, err := mdb.LoadSnapshot(snapshotDir)
+		if err != nil && err != db.ErrNoSnapshot {
+			log.Fatal(err)
+		}
+		if err == nil {
+			log.Printf("Loaded snapshot %s", path)
+			loaded = true
+		}
+	}
+	if !loaded {
+		if err := mdb.LoadFromCSV(dataPath, batchSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//replay logged writes over the loaded data before serving
+	if walPath != "" {
+		if err := mdb.OpenWAL(walPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if snapshotDir != "" {
+		mdb.StartSnapshots(snapshotDir, snapshotInterval, snapshotRetain)
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var jwtAuth *api.JWTAuthenticator
+	if jwksSource != "" {
+		roleMap, err := api.ParseRoleMap(jwtRoleMap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		jwtAuth, err = api.InitJWTAuthenticator(api.JWTConfig{
+			JWKS:      jwksSource,
+			Refresh:   jwksRefresh,
+			Issuer:    jwtIssuer,
+			Audience:  jwtAudience,
+			RoleClaim: jwtRoleClaim,
+			RoleMap:   roleMap,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	mdb.LoadFromCSV(dataPath, batchSize)
+	//reload credentials on SIGHUP, keeping the old ones if the new are bad
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := users.Reload(); err != nil {
+				log.Printf("Error reloading users, keeping previous credentials: %s", err)
+			} else {
+				log.Print("Reloaded users")
+			}
+			if jwtAuth != nil {
+				if err := jwtAuth.Reload(); err != nil {
+					log.Printf("Error reloading JWKS, keeping previous keys: %s", err)
+				} else {
+					log.Print("Reloaded JWKS")
+				}
+			}
+		}
+	}()
 
 	//instantiate api and register routes
-	apiHandle, err := api.InitAPI(mdb)
+	apiHandle, err := api.InitAPI(mdb, users)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if jwtAuth != nil {
+		apiHandle.AddAuthenticator(jwtAuth)
+	}
+	apiHandle.SetIdempotencyWindow(idempotencyWindow)
+	proxies, err := api.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiHandle.SetTrustedProxies(proxies)
+	apiHandle.SetRateLimit(api.RateLimitConfig{
+		PerClient: api.RateLimit{Rate: rateLimit, Burst: rateBurst},
+		Global:    api.RateLimit{Rate: globalRateLimit, Burst: globalRateBurst},
+	})
+	apiHandle.SetMaxStoredBytes(maxStoredBytes)
+	bodyLimits, err := api.ParseBodyLimits(maxBodyRoutes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiHandle.SetBodyLimits(maxBody, bodyLimits)
+	pipeline, err := moderationPipeline()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := apiHandle.SetModeration(pipeline); err != nil {
+		log.Fatal(err)
+	}
 
 	//listen
 	log.Fatal(http.ListenAndServe("0.0.0.0:9000", apiHandle.GetRouter()))
 
 }
+
+// loadUsers loads the private route credentials from the -users file, or
+// failing that the environment. With neither, it falls back to the legacy
+// admin/back-challenge login, which cannot be rotated
+func loadUsers() (*api.UserStore, error) {
+	if usersPath != "" {
+		return api.LoadUserFile(usersPath)
+	}
+	if _, ok := os.LookupEnv(usersEnv); ok {
+		return api.LoadUserEnv(usersEnv)
+	}
+	log.Printf("WARNING: no -users file or $%s set, using the default admin credentials", usersEnv)
+	return api.InitUserStore("admin", "back-challenge", api.RoleAdmin, bcrypt.DefaultCost)
+}
+
+// moderationPipeline builds the filters public messages pass through from the flags
+func moderationPipeline() (*moderation.Pipeline, error) {
+	var filters []moderation.Filter
+	if blocklistPath != "" {
+		blocklist, err := moderation.LoadBlocklist(blocklistPath, moderation.Quarantine)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, blocklist)
+	}
+	filters = append(filters, &moderation.LinkLimit{Quarantine: quarantineLinks, Reject: rejectLinks})
+	if repeatMax > 0 {
+		filters = append(filters, moderation.InitRepeats(repeatWindow, repeatMax, moderation.Quarantine))
+	}
+	filters = append(filters, moderation.InitBayes(spamQuarantine, spamReject))
+	return moderation.InitPipeline(filters...), nil
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/imw-challenge/back/types"
+)
+
+// ErrKeyNotFound is returned when an API key does not exist, or is already revoked
+var ErrKeyNotFound = errors.New("API key not found")
+
+// InsertAPIKey stores a new API key, or replaces one with the same ID
+func (m *MessageDB) InsertAPIKey(key *types.APIKey) error {
+	txn := m.writeTxn()
+	if err := txn.Insert("apikey", key); err != nil {
+		txn.Abort()
+		return err
+	}
+	return m.commit(txn, &walRecord{Op: walOpPutKey, Keys: []*types.APIKey{key}})
+}
+
+// FetchAPIKey fetches an API key by ID, including revoked and expired keys
+func (m *MessageDB) FetchAPIKey(ID string) (*types.APIKey, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	raw, err := txn.First("apikey", "id", ID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, ErrKeyNotFound
+	}
+	return raw.(*types.APIKey), nil
+}
+
+// FetchAPIKeys returns every API key, ordered by ID
+func (m *MessageDB) FetchAPIKeys() ([]*types.APIKey, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get("apikey", "id")
+	if err != nil {
+		return nil, err
+	}
+	var keys []*types.APIKey
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		keys = append(keys, obj.(*types.APIKey))
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks an API key revoked at the given time, returning
+// ErrKeyNotFound if there is no such key or it is already revoked.
+// Revoked keys are kept so that they can still be listed
+func (m *MessageDB) RevokeAPIKey(ID string, at int64) error {
+	txn := m.writeTxn()
+
+	raw, err := txn.First("apikey", "id", ID)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+	if raw == nil || raw.(*types.APIKey).Revoked != 0 {
+		txn.Abort()
+		return ErrKeyNotFound
+	}
+
+	revoked := *raw.(*types.APIKey)
+	revoked.Revoked = at
+	if err := txn.Insert("apikey", &revoked); err != nil {
+		txn.Abort()
+		return err
+	}
+	return m.commit(txn, &walRecord{Op: walOpPutKey, Keys: []*types.APIKey{&revoked}})
+}
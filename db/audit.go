@@ -0,0 +1,188 @@
+package db
+
+import (
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/imw-challenge/back/types"
+)
+
+// Audit holds the context of one request, copied into an audit entry for
+// each message changed through a handle returned by WithAudit
+type Audit struct {
+	Entry   types.AuditEntry
+	Written int //entries recorded so far
+}
+
+// AuditFilter selects audit entries, zero fields match every entry
+type AuditFilter struct {
+	Principal string
+	MessageID string
+	Method    string
+	Route     string
+	Start     int64 //Unix Epoch Seconds, inclusive
+	End       int64 //Unix Epoch Seconds, inclusive, zero for no limit
+}
+
+func (f *AuditFilter) match(e *types.AuditEntry) bool {
+	seconds := e.Time / int64(time.Second)
+	return (f.Principal == "" || e.Principal == f.Principal) &&
+		(f.MessageID == "" || e.MessageID == f.MessageID) &&
+		(f.Method == "" || e.Method == f.Method) &&
+		(f.Route == "" || e.Route == f.Route) &&
+		seconds >= f.Start && (f.End == 0 || seconds <= f.End)
+}
+
+// WithAudit returns a handle on the database whose writes also record an
+// audit entry for each message they change, in the same transaction, so that
+// no change is made without its entry. Handles are meant for a single request
+func (m *MessageDB) WithAudit(audit *Audit) *MessageDB {
+	audited := *m
+	audited.audit = audit
+	return &audited
+}
+
+// SetAuditRetention limits how long audit entries are kept, and how many.
+// Once either is exceeded the oldest entries are dropped as new ones are
+// recorded. Zero for either leaves it unlimited
+func (m *MessageDB) SetAuditRetention(maxAge time.Duration, maxEntries int) {
+	m.auditMaxAge = maxAge
+	m.auditMaxEntries = maxEntries
+}
+
+// InsertAudit records an audit entry for a call which changed no messages
+func (m *MessageDB) InsertAudit(entry *types.AuditEntry) error {
+	txn := m.writeTxn()
+	entries := []*types.AuditEntry{entry}
+	if err := m.insertAudit(txn, entries); err != nil {
+		txn.Abort()
+		return err
+	}
+	return m.commit(txn, &walRecord{Op: walOpAudit, Audit: entries})
+}
+
+// auditChanges records an entry for each message changed in txn
+func (m *MessageDB) auditChanges(txn *memdb.Txn) ([]*types.AuditEntry, error) {
+	var entries []*types.AuditEntry
+	for _, change := range txn.Changes() {
+		if change.Table != "message" {
+			continue
+		}
+		entry := m.audit.Entry
+		entry.Old, _ = change.Before.(*types.Message)
+		entry.New, _ = change.After.(*types.Message)
+		if entry.New != nil {
+			entry.MessageID = entry.New.ID
+		} else {
+			entry.MessageID = entry.Old.ID
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, m.insertAudit(txn, entries)
+}
+
+// insertAudit numbers entries after the last in the table and inserts them,
+// then drops any entries past the retention limits
+func (m *MessageDB) insertAudit(txn *memdb.Txn, entries []*types.AuditEntry) error {
+	var seq uint64
+	last, err := txn.Last("audit", "id")
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		seq = last.(*types.AuditEntry).Seq
+	}
+	for _, entry := range entries {
+		seq++
+		entry.Seq = seq
+		if entry.Time == 0 {
+			entry.Time = time.Now().UnixNano()
+		}
+		if err := txn.Insert("audit", entry); err != nil {
+			return err
+		}
+	}
+	return m.pruneAudit(txn)
+}
+
+// pruneAudit drops the oldest audit entries while there are more than
+// auditMaxEntries, or they are older than auditMaxAge. Entries are numbered
+// in the order they are recorded and only ever dropped from the front, so
+// their count is the span of their numbers
+// pruning is not logged to the WAL, but happens again as entries are replayed
+func (m *MessageDB) pruneAudit(txn *memdb.Txn) error {
+	if m.auditMaxAge == 0 && m.auditMaxEntries == 0 {
+		return nil
+	}
+	last, err := txn.Last("audit", "id")
+	if err != nil || last == nil {
+		return err
+	}
+	newest := last.(*types.AuditEntry).Seq
+	cutoff := time.Now().Add(-m.auditMaxAge).UnixNano()
+
+	it, err := txn.Get("audit", "id")
+	if err != nil {
+		return err
+	}
+	var expired []*types.AuditEntry
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		entry := obj.(*types.AuditEntry)
+		tooMany := m.auditMaxEntries > 0 && newest-entry.Seq >= uint64(m.auditMaxEntries)
+		tooOld := m.auditMaxAge > 0 && entry.Time < cutoff && entry.Seq != newest
+		if !tooMany && !tooOld {
+			break
+		}
+		expired = append(expired, entry)
+	}
+	//deleting while iterating is not safe within a transaction
+	for _, entry := range expired {
+		if err := txn.Delete("audit", entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FetchAudit returns up to limit audit entries matching filter, oldest first
+// if ascending or newest first if not, strictly past the entry numbered after
+// in that order. An after of zero starts from the first entry
+func (m *MessageDB) FetchAudit(filter AuditFilter, ascending bool, after uint64, limit int) ([]*types.AuditEntry, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	//secondary indexes keep the entries for each value in Seq order
+	var it memdb.ResultIterator
+	var err error
+	switch {
+	case filter.MessageID != "" && ascending:
+		it, err = txn.Get("audit", "message", filter.MessageID)
+	case filter.MessageID != "":
+		it, err = txn.GetReverse("audit", "message", filter.MessageID)
+	case filter.Principal != "" && ascending:
+		it, err = txn.Get("audit", "principal", filter.Principal)
+	case filter.Principal != "":
+		it, err = txn.GetReverse("audit", "principal", filter.Principal)
+	case ascending:
+		it, err = txn.LowerBound("audit", "id", after+1)
+	case after == 0:
+		it, err = txn.GetReverse("audit", "id")
+	default:
+		it, err = txn.ReverseLowerBound("audit", "id", after-1)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*types.AuditEntry
+	for obj := it.Next(); obj != nil && len(entries) < limit; obj = it.Next() {
+		entry := obj.(*types.AuditEntry)
+		if after != 0 && (ascending && entry.Seq <= after || !ascending && entry.Seq >= after) {
+			continue
+		}
+		if filter.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
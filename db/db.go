@@ -3,17 +3,42 @@ package db
 import (
 	"encoding/csv"
 	"errors"
+	"math"
 	"os"
-	"sort"
+	"strings"
 	"time"
 
+	"github.com/imw-challenge/back/search"
 	"github.com/imw-challenge/back/types"
 
 	"github.com/hashicorp/go-memdb"
 )
 
+// ErrNotFound is returned when a message does not exist, or is soft-deleted
+var ErrNotFound = errors.New("Message not found")
+
+// ErrPreconditionFailed is returned when a conditional update finds the
+// message has changed since the caller read it
+var ErrPreconditionFailed = errors.New("Message has changed")
+
+// ErrConflict is returned when creating a message whose ID is taken by a different message
+var ErrConflict = errors.New("Message ID already exists")
+
 type MessageDB struct {
-	db *memdb.MemDB
+	db         *memdb.MemDB
+	wal        *wal
+	index      *search.Index
+	softDelete bool
+	stored     *int64 //shared by every handle, see StoredBytes
+	walFrom    int64  //WAL position the loaded snapshot holds the writes up to
+
+	//audit entries are dropped once older than auditMaxAge, or once there
+	//are more than auditMaxEntries, see SetAuditRetention
+	auditMaxAge     time.Duration
+	auditMaxEntries int
+
+	//audit, if set, is recorded with every message this handle changes
+	audit *Audit
 }
 
 type ResultIter memdb.ResultIterator
@@ -35,6 +60,104 @@ func InitMessageDB() (*MessageDB, error) {
 						Unique:  false,
 						Indexer: &memdb.IntFieldIndex{Field: "Time"},
 					},
+					//by sender and then time, so that a sender's messages
+					//can be scanned as the time index is
+					"email": &memdb.IndexSchema{
+						Name:         "email",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Email", Lowercase: true},
+								&memdb.IntFieldIndex{Field: "Time"},
+							},
+						},
+					},
+					"name": &memdb.IndexSchema{
+						Name:         "name",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Name"},
+								&memdb.IntFieldIndex{Field: "Time"},
+							},
+						},
+					},
+					//by status and then time, so that the messages in a
+					//status can be scanned as the time index is
+					"status": &memdb.IndexSchema{
+						Name:   "status",
+						Unique: false,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "Status"},
+								&memdb.IntFieldIndex{Field: "Time"},
+							},
+						},
+					},
+				},
+			},
+			"revision": &memdb.TableSchema{
+				Name: "revision",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:   "id",
+						Unique: true,
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.StringFieldIndex{Field: "ID"},
+								&memdb.IntFieldIndex{Field: "Version"},
+							},
+						},
+					},
+					"message": &memdb.IndexSchema{
+						Name:    "message",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "ID"},
+					},
+				},
+			},
+			"audit": &memdb.TableSchema{
+				Name: "audit",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.UintFieldIndex{Field: "Seq"},
+					},
+					"principal": &memdb.IndexSchema{
+						Name:         "principal",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Principal"},
+					},
+					"message": &memdb.IndexSchema{
+						Name:         "message",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "MessageID"},
+					},
+				},
+			},
+			"apikey": &memdb.TableSchema{
+				Name: "apikey",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "ID"},
+					},
+				},
+			},
+			"review": &memdb.TableSchema{
+				Name: "review",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "ID"},
+					},
 				},
 			},
 		},
@@ -45,7 +168,142 @@ func InitMessageDB() (*MessageDB, error) {
 	if err != nil {
 		return &MessageDB{}, err
 	}
-	return &MessageDB{mdb}, nil
+	return &MessageDB{db: mdb, index: search.InitIndex(), stored: new(int64)}, nil
+}
+
+// OpenWAL replays the write-ahead log at path into the database, then logs
+// every subsequent insert to it so acknowledged writes survive a restart.
+// Records already held by a snapshot loaded beforehand are skipped, and
+// ErrWALGap is returned if the log was compacted past the data loaded
+func (m *MessageDB) OpenWAL(path string) error {
+	if m.wal != nil {
+		return errors.New("WAL already open")
+	}
+	w, err := openWAL(path, m.walFrom, m.applyRecord)
+	if err != nil {
+		return err
+	}
+	m.wal = w
+	return nil
+}
+
+// Close closes the write-ahead log, if one is open
+func (m *MessageDB) Close() error {
+	if m.wal == nil {
+		return nil
+	}
+	err := m.wal.close()
+	m.wal = nil
+	return err
+}
+
+// applyRecord applies a replayed WAL record without logging it again
+func (m *MessageDB) applyRecord(rec *walRecord) error {
+	txn := m.writeTxn()
+	switch rec.Op {
+	case walOpInsert:
+		for _, message := range rec.Messages {
+			//records written before messages were versioned are versioned on replay
+			if message.Version == 0 {
+				if err := stampVersion(txn, message, time.Now().Unix()); err != nil {
+					txn.Abort()
+					return err
+				}
+			}
+			//and records written before messages had a status are new
+			if message.Status == "" {
+				message.Status = types.StatusNew
+			}
+			if err := txn.Insert("message", message); err != nil {
+				txn.Abort()
+				return err
+			}
+			if err := putRevision(txn, message); err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+	case walOpDelete:
+		for _, ID := range rec.IDs {
+			if _, err := txn.DeleteAll("message", "id", ID); err != nil {
+				txn.Abort()
+				return err
+			}
+			if _, err := txn.DeleteAll("revision", "message", ID); err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+	case walOpPutKey:
+		for _, key := range rec.Keys {
+			if err := txn.Insert("apikey", key); err != nil {
+				txn.Abort()
+				return err
+			}
+		}
+	case walOpAudit, walOpReview:
+	default:
+		txn.Abort()
+		return errors.New("Unknown WAL operation: " + rec.Op)
+	}
+	for _, review := range rec.Reviews {
+		if err := txn.Insert("review", review); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	for _, entry := range rec.Audit {
+		if err := txn.Insert("audit", entry); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	if len(rec.Audit) > 0 {
+		if err := m.pruneAudit(txn); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	m.updateIndex(txn)
+	m.updateSize(txn)
+	txn.Commit()
+	return nil
+}
+
+// writeTxn starts a write transaction which tracks its changes,
+// so that they can be applied to the search index on commit
+func (m *MessageDB) writeTxn() *memdb.Txn {
+	txn := m.db.Txn(true)
+	txn.TrackChanges()
+	return txn
+}
+
+// commit logs rec to the WAL, if one is open, and commits txn
+// the transaction is aborted if the log write fails, so nothing is
+// visible in memory that has not been made durable
+// on an audited handle, the changes to messages are audited in the same transaction
+func (m *MessageDB) commit(txn *memdb.Txn, rec *walRecord) error {
+	if m.audit != nil {
+		entries, err := m.auditChanges(txn)
+		if err != nil {
+			txn.Abort()
+			return err
+		}
+		rec.Audit = entries
+	}
+	if m.wal != nil {
+		if err := m.wal.append(rec); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	m.updateIndex(txn)
+	m.updateSize(txn)
+	txn.Commit()
+	if m.audit != nil {
+		m.audit.Written += len(rec.Audit)
+	}
+	return nil
 }
 
 func (m *MessageDB) LoadFromCSV(filename string, batchSize int) error {
@@ -90,33 +348,132 @@ func (m *MessageDB) LoadFromCSV(filename string, batchSize int) error {
 }
 
 // Insert creates if message does not exist, updates if it does exist
+// each message is stamped with its new version, and kept as a revision
 func (m *MessageDB) InsertMessages(messages []*types.Message) error {
 	// Create a write transaction
-	txn := m.db.Txn(true)
+	txn := m.writeTxn()
 
-	for _, m := range messages {
-		if err := txn.Insert("message", m); err != nil {
+	now := time.Now().Unix()
+	for _, message := range messages {
+		if err := m.putMessage(txn, message, now); err != nil {
+			txn.Abort()
 			return err
 		}
 	}
 
 	// Commit the transaction
-	txn.Commit()
-	return nil
+	return m.commit(txn, &walRecord{Op: walOpInsert, Messages: messages})
 }
 
 // InsertMessage creates a message if it does not exist, or updates if it does exist
+// the message is stamped with its new version, and kept as a revision
 func (m *MessageDB) InsertMessage(message *types.Message) error {
 	// Create a write transaction
-	txn := m.db.Txn(true)
+	txn := m.writeTxn()
 
-	if err := txn.Insert("message", message); err != nil {
+	if err := m.putMessage(txn, message, time.Now().Unix()); err != nil {
+		txn.Abort()
 		return err
 	}
 
 	// Commit the transaction
-	txn.Commit()
-	return nil
+	return m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{message}})
+}
+
+// CreateMessage stores a new message, unless a message with its ID is already
+// stored. If that message has the same content, nothing is stored and it is
+// returned with created false, so that repeating a create is harmless;
+// otherwise ErrConflict is returned. Soft-deleted messages keep their IDs, so
+// they are never replaced either, nor are messages held for review, for which
+// ErrHeld is returned if the content is the same. The check and write happen
+// in one write transaction
+func (m *MessageDB) CreateMessage(message *types.Message) (*types.Message, bool, error) {
+	txn := m.writeTxn()
+
+	existing, err := fetchPosted(txn, message)
+	if err != ErrNotFound {
+		txn.Abort()
+		return existing, false, err
+	}
+
+	if err := m.putMessage(txn, message, time.Now().Unix()); err != nil {
+		txn.Abort()
+		return nil, false, err
+	}
+	if err := m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{message}}); err != nil {
+		return nil, false, err
+	}
+	return message, true, nil
+}
+
+// FetchPosted looks for an earlier post of a message by its ID, without
+// storing anything. It returns the stored message if it is the same, ErrHeld if
+// the same message is held for review, ErrConflict if the ID is taken by a
+// different message, or ErrNotFound if the ID is free
+func (m *MessageDB) FetchPosted(message *types.Message) (*types.Message, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+	return fetchPosted(txn, message)
+}
+
+func fetchPosted(txn *memdb.Txn, message *types.Message) (*types.Message, error) {
+	raw, err := txn.First("message", "id", message.ID)
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		existing := raw.(*types.Message)
+		if existing.DeletedAt != 0 || !sameContent(existing, message) {
+			return nil, ErrConflict
+		}
+		return existing, nil
+	}
+	if err := checkHeld(txn, message); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// sameContent reports whether two messages hold the same fields, ignoring
+// their bookkeeping
+func sameContent(a, b *types.Message) bool {
+	return a.ID == b.ID && a.Name == b.Name && a.Email == b.Email &&
+		a.Text == b.Text && a.Time == b.Time && a.TZ == b.TZ
+}
+
+// UpdateMessage applies update to a copy of the message with ID and stores it
+// as a new version, returning the message as stored. If precondition is not nil
+// it is checked against the current message first, and ErrPreconditionFailed
+// returned if it fails. If update returns an error, nothing is stored and the
+// error is returned. The read, check and write happen in one write
+// transaction, so no other write can come between them
+func (m *MessageDB) UpdateMessage(ID string, precondition func(*types.Message) bool, update func(*types.Message) error) (*types.Message, error) {
+	txn := m.writeTxn()
+
+	current, err := liveMessage(txn, ID)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if precondition != nil && !precondition(current) {
+		txn.Abort()
+		return nil, ErrPreconditionFailed
+	}
+
+	updated := *current
+	if err := update(&updated); err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	updated.ID = ID
+	if err := m.putMessage(txn, &updated, time.Now().Unix()); err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if err := m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{&updated}}); err != nil {
+		return nil, err
+	}
+	return &updated, nil
 }
 
 // FetchAll returns a slice with all the messages in the database, in non-deterministic order
@@ -130,7 +487,9 @@ func (m *MessageDB) FetchAll() ([]*types.Message, error) {
 	var messages []*types.Message
 	for obj := it.Next(); obj != nil; obj = it.Next() {
 		m := obj.(*types.Message)
-		messages = append(messages, m)
+		if m.DeletedAt == 0 {
+			messages = append(messages, m)
+		}
 	}
 	return messages, nil
 }
@@ -146,51 +505,279 @@ func (m *MessageDB) FetchByID(ID string) (*types.Message, error) {
 	if err != nil {
 		return nil, err
 	}
-	if raw != nil { //message found
+	if raw != nil && raw.(*types.Message).DeletedAt == 0 { //message found
 		return raw.(*types.Message), nil
 	} else {
-		return &types.Message{}, errors.New("Message not found")
+		return &types.Message{}, ErrNotFound
 	}
 }
 
-// fetchByMinTime returns a result iterator for messages with a timestamp
-// at or after the specified start in unix seconds
-func (m *MessageDB) fetchByMinTime(start int64) (ResultIter, error) {
-	txn := m.db.Txn(false)
-	defer txn.Abort()
+// SetSoftDelete switches DeleteMessage between removing messages outright
+// and marking them deleted so that they can later be restored
+func (m *MessageDB) SetSoftDelete(soft bool) {
+	m.softDelete = soft
+}
+
+// DeleteMessage deletes a message by ID, returning ErrNotFound if there is no
+// such message. In soft-delete mode the message is kept, but hidden from all
+// fetches until it is restored. Otherwise its revisions are removed with it
+func (m *MessageDB) DeleteMessage(ID string) error {
+	txn := m.writeTxn()
+
+	raw, err := txn.First("message", "id", ID)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+	if raw == nil || raw.(*types.Message).DeletedAt != 0 {
+		txn.Abort()
+		return ErrNotFound
+	}
+
+	if m.softDelete {
+		deleted := *raw.(*types.Message)
+		deleted.DeletedAt = time.Now().Unix()
+		if err := txn.Insert("message", &deleted); err != nil {
+			txn.Abort()
+			return err
+		}
+		return m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{&deleted}})
+	}
+
+	if err := txn.Delete("message", raw); err != nil {
+		txn.Abort()
+		return err
+	}
+	if _, err := txn.DeleteAll("revision", "message", ID); err != nil {
+		txn.Abort()
+		return err
+	}
+	return m.commit(txn, &walRecord{Op: walOpDelete, IDs: []string{ID}})
+}
 
-	it, err := txn.LowerBound("message", "time", start)
+// RestoreMessage brings back a soft-deleted message, returning ErrNotFound
+// if there is no deleted message with this ID
+func (m *MessageDB) RestoreMessage(ID string) error {
+	txn := m.writeTxn()
+
+	raw, err := txn.First("message", "id", ID)
 	if err != nil {
-		return it, err
+		txn.Abort()
+		return err
+	}
+	if raw == nil || raw.(*types.Message).DeletedAt == 0 {
+		txn.Abort()
+		return ErrNotFound
 	}
-	return it, nil
 
+	restored := *raw.(*types.Message)
+	restored.DeletedAt = 0
+	if err := txn.Insert("message", &restored); err != nil {
+		txn.Abort()
+		return err
+	}
+	return m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{&restored}})
 }
 
+// errStopScan ends a scan early without reporting an error
+var errStopScan = errors.New("stop scan")
+
 // FetchSortedByTime returns a slice of messages with timestamps between
 // start and end (inclusive), specified in unix seconds - the ordering of this array
 // is chronological if ascending is true, or reverse chronological if false
 func (m *MessageDB) FetchSortedByTime(start int64, end int64, ascending bool) ([]*types.Message, error) {
-	//fetch by time
 	var messages []*types.Message
-	it, err := m.fetchByMinTime(start)
+	err := m.ScanByTime(start, end, ascending, func(message *types.Message) error {
+		messages = append(messages, message)
+		return nil
+	})
 	if err != nil {
 		return []*types.Message{}, err
 	}
+	return messages, nil
+}
+
+// ScanByTime calls fn for each message with a timestamp between start and end
+// (inclusive), in the same order as FetchSortedByTime, without collecting them.
+// Messages are read straight from the time index of a single read transaction,
+// so memory use does not grow with the size of the table. Scanning stops at
+// the first error returned by fn, which is passed back to the caller
+func (m *MessageDB) ScanByTime(start int64, end int64, ascending bool, fn func(*types.Message) error) error {
+	return m.scanByTime(nil, start, end, ascending, nil, fn)
+}
+
+// ScanByStatus is ScanByTime over only the messages in a status, which are
+// read from the status index rather than found among the rest. An empty
+// status scans every message
+func (m *MessageDB) ScanByStatus(status string, start int64, end int64, ascending bool, fn func(*types.Message) error) error {
+	return m.scanByTime(statusScope(status), start, end, ascending, nil, fn)
+}
+
+// Cursor is a position in the (Time, ID) ordering of messages
+type Cursor struct {
+	Time int64
+	ID   string
+}
+
+// FetchPage returns up to limit messages with timestamps between start and end
+// (inclusive), in the same order as FetchSortedByTime. If after is not nil, only
+// messages strictly past that position in the ordering are returned, so paging
+// by the last message of each page is stable while new messages arrive
+func (m *MessageDB) FetchPage(start int64, end int64, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	return m.fetchPage(nil, start, end, ascending, after, limit)
+}
+
+// FetchStatusPage is FetchPage over only the messages in a status, as for ScanByStatus
+func (m *MessageDB) FetchStatusPage(status string, start int64, end int64, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	return m.fetchPage(statusScope(status), start, end, ascending, after, limit)
+}
+
+// FetchByEmail returns a page of the messages sent from an email address,
+// compared case-insensitively, as FetchPage does over every time
+func (m *MessageDB) FetchByEmail(email string, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	email = strings.ToLower(email)
+	return m.fetchPage(&scope{index: "email", key: email, holds: func(message *types.Message) bool {
+		return strings.ToLower(message.Email) == email
+	}}, 0, math.MaxInt64, ascending, after, limit)
+}
+
+// FetchByName returns a page of the messages sent under an exact name, as
+// FetchPage does over every time
+func (m *MessageDB) FetchByName(name string, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	return m.fetchPage(&scope{index: "name", key: name, holds: func(message *types.Message) bool {
+		return message.Name == name
+	}}, 0, math.MaxInt64, ascending, after, limit)
+}
+
+// FetchByEmailPrefix returns a page of the messages sent from email addresses
+// starting with prefix, compared case-insensitively, as FetchPage does over
+// every time. Matching senders are spread across the time order, so this walks
+// the time index until the page is full, rather than reading only the matches
+func (m *MessageDB) FetchByEmailPrefix(prefix string, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	prefix = strings.ToLower(prefix)
+	return m.fetchPage(&scope{index: "time", holds: func(message *types.Message) bool {
+		return strings.HasPrefix(strings.ToLower(message.Email), prefix)
+	}}, 0, math.MaxInt64, ascending, after, limit)
+}
+
+// scope narrows a scan to some of the messages. index is either a compound
+// index of key and then time, which holds just the messages in scope
+// together, or the time index, whose messages are checked one by one
+type scope struct {
+	index string
+	key   interface{}
+	holds func(*types.Message) bool //whether a message is in scope
+}
+
+// statusScope narrows a scan to the messages in status, or to none if it is empty
+func statusScope(status string) *scope {
+	if status == "" {
+		return nil
+	}
+	return &scope{index: "status", key: status, holds: func(message *types.Message) bool {
+		return message.Status == status
+	}}
+}
+
+func (m *MessageDB) fetchPage(in *scope, start int64, end int64, ascending bool, after *Cursor, limit int) ([]*types.Message, error) {
+	var messages []*types.Message
+	err := m.scanByTime(in, start, end, ascending, after, func(message *types.Message) error {
+		if len(messages) == limit {
+			return errStopScan
+		}
+		messages = append(messages, message)
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return []*types.Message{}, err
+	}
+	return messages, nil
+}
+
+// scanByTime walks the time index from whichever of the window bound and the
+// cursor comes later in the scan order, stopping as soon as it leaves the window.
+// The index orders messages by time and then ID, so it is already in the order
+// we want, read forwards for ascending and backwards for descending
+// if in is not nil, its compound index is walked instead, within its key
+func (m *MessageDB) scanByTime(in *scope, start int64, end int64, ascending bool, after *Cursor, fn func(*types.Message) error) error {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	if after != nil {
+		if ascending && after.Time > start {
+			start = after.Time
+		}
+		if !ascending && after.Time < end {
+			end = after.Time
+		}
+	}
+
+	index, bound := "time", func(t int64) []interface{} { return []interface{}{t} }
+	keyed := in != nil && in.index != "time"
+	if keyed {
+		index, bound = in.index, func(t int64) []interface{} { return []interface{}{in.key, t} }
+	}
+	var it memdb.ResultIterator
+	var err error
+	switch {
+	case ascending:
+		it, err = txn.LowerBound("message", index, bound(start)...)
+	case end == math.MaxInt64 && !keyed:
+		it, err = txn.GetReverse("message", "time")
+	case end == math.MaxInt64:
+		//times come from RFC3339, so no message is stored at the very end
+		it, err = txn.ReverseLowerBound("message", index, bound(end)...)
+	default:
+		//index keys are the time followed by the ID, so every message at
+		//end sorts after the bare key for end, but before the one for end+1
+		it, err = txn.ReverseLowerBound("message", index, bound(end+1)...)
+	}
+	if err != nil {
+		return err
+	}
 
-	//insert into slice
+	var pos *types.Message
+	if after != nil {
+		pos = &types.Message{Time: after.Time, ID: after.ID}
+	}
 	for obj := it.Next(); obj != nil; obj = it.Next() {
-		m := obj.(*types.Message)
-		if m.Time <= end {
-			messages = append(messages, m)
+		message := obj.(*types.Message)
+		if keyed && !in.holds(message) {
+			break
+		}
+		if ascending && message.Time > end {
+			break
+		}
+		if !ascending && message.Time < start {
+			break
+		}
+		if message.Time > end || message.DeletedAt != 0 {
+			continue
+		}
+		if in != nil && !keyed && !in.holds(message) {
+			continue
+		}
+		//skip messages sharing the cursor's time, up to and including it
+		if pos != nil {
+			past := lessByTime(pos, message)
+			if !ascending {
+				past = lessByTime(message, pos)
+			}
+			if !past {
+				continue
+			}
+		}
+		if err := fn(message); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	//sort slice
-	if ascending {
-		sort.Slice(messages, func(i, j int) bool { return messages[i].Time < messages[j].Time })
-	} else {
-		sort.Slice(messages, func(i, j int) bool { return messages[i].Time > messages[j].Time })
+// lessByTime orders messages by time, then by ID
+func lessByTime(a, b *types.Message) bool {
+	if a.Time != b.Time {
+		return a.Time < b.Time
 	}
-	return messages, nil
+	return a.ID < b.ID
 }
@@ -1,9 +1,22 @@
 package db
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/imw-challenge/back/search"
 	"github.com/imw-challenge/back/types"
 )
 
@@ -93,3 +106,1384 @@ func TestFetchAntiChrono(t *testing.T) {
 		t.Errorf("Results not sorted reverse chronologically")
 	}
 }
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	testMessages := getTestMessages()
+	if err := mdb.InsertMessages(testMessages[:3]); err != nil {
+		t.Fatalf("Error inserting messages: %s", err)
+	}
+	if err := mdb.InsertMessage(testMessages[3]); err != nil {
+		t.Fatalf("Error inserting message: %s", err)
+	}
+	updated := *testMessages[0]
+	updated.Text = "edited before the crash"
+	if err := mdb.InsertMessage(&updated); err != nil {
+		t.Fatalf("Error updating message: %s", err)
+	}
+	//simulate a crash by abandoning mdb without closing it
+
+	reopened := initEmptyDB()
+	if err := reopened.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer reopened.Close()
+
+	contents, err := reopened.FetchAll()
+	if err != nil {
+		t.Errorf("Error fetching results: %s", err)
+	}
+	if len(contents) != 4 {
+		t.Errorf("Expected to find 4 messages after replay, found %d", len(contents))
+	}
+	message, err := reopened.FetchByID(updated.ID)
+	if err != nil {
+		t.Fatalf("Error fetching message %s: %s", updated.ID, err)
+	}
+	if message.Text != updated.Text {
+		t.Errorf("Expected replayed text %q. Got %q", updated.Text, message.Text)
+	}
+	if message.Time != updated.Time || message.TZ != updated.TZ {
+		t.Errorf("Expected replayed time %d/%d. Got %d/%d", updated.Time, updated.TZ, message.Time, message.TZ)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waltorn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	testMessages := getTestMessages()
+	if err := mdb.InsertMessages(testMessages[:2]); err != nil {
+		t.Fatalf("Error inserting messages: %s", err)
+	}
+	mdb.Close()
+
+	//append half a record, as if the process died mid-write
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3})
+	f.Close()
+
+	reopened := initEmptyDB()
+	if err := reopened.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL with torn tail: %s", err)
+	}
+	if err := reopened.InsertMessage(testMessages[2]); err != nil {
+		t.Fatalf("Error inserting after replay: %s", err)
+	}
+	reopened.Close()
+
+	//writes made after the torn tail must not be hidden behind it
+	final := initEmptyDB()
+	if err := final.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer final.Close()
+	contents, err := final.FetchAll()
+	if err != nil {
+		t.Errorf("Error fetching results: %s", err)
+	}
+	if len(contents) != 3 {
+		t.Errorf("Expected to find 3 messages after replay, found %d", len(contents))
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walcorrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+	appendFrame := func(frame []byte) {
+		f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(frame)
+		f.Close()
+	}
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	mdb.InsertMessages(getTestMessages()[:2])
+	mdb.Close()
+
+	//a huge length is the end of the log, not an allocation
+	appendFrame([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	reopened := initEmptyDB()
+	if err := reopened.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL with a corrupt length: %s", err)
+	}
+	reopened.Close()
+	info, _ := os.Stat(walPath)
+	good := info.Size()
+
+	//a record with a good checksum which cannot be decoded is an error,
+	//and the log is kept as it is
+	payload := []byte("not a gob")
+	frame := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	appendFrame(append(frame, payload...))
+	if err := initEmptyDB().OpenWAL(walPath); err == nil {
+		t.Error("Expected an undecodable record to be refused")
+	}
+	if info, _ := os.Stat(walPath); info.Size() != good+walHeaderSize+int64(len(payload)) {
+		t.Errorf("Expected the log to be left untruncated. Got %d bytes", info.Size())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mdb := initPopulatedDB()
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	contents, err := restored.FetchAll()
+	if err != nil {
+		t.Errorf("Error fetching results: %s", err)
+	}
+	if len(contents) != len(getTestMessages()) {
+		t.Errorf("Expected to restore %d messages, found %d", len(getTestMessages()), len(contents))
+	}
+	message, err := restored.FetchByID("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A")
+	if err != nil || message.Name != "Alex Mustermann" {
+		t.Errorf("Error restoring message 2C7BCEC7-CD14-D6E5-3FBF-F9551375429A: %v", err)
+	}
+}
+
+func TestStoredBytes(t *testing.T) {
+	mdb := initEmptyDB()
+	if mdb.StoredBytes() != 0 {
+		t.Fatalf("Expected an empty database to store nothing. Got %d", mdb.StoredBytes())
+	}
+	message := &types.Message{ID: "ID", Text: "1234567890"}
+	mdb.InsertMessage(message)
+	//the message and its first revision
+	one := 2 * (int64(len("ID")+len("1234567890")) + messageOverhead)
+	if mdb.StoredBytes() != one {
+		t.Errorf("Expected %d bytes stored. Got %d", one, mdb.StoredBytes())
+	}
+
+	mdb.UpdateMessage("ID", nil, func(message *types.Message) error {
+		message.Text = "12345"
+		return nil
+	})
+	edited := one - 5 + int64(len("ID")+len("12345")) + messageOverhead
+	if mdb.StoredBytes() != edited {
+		t.Errorf("Expected %d bytes stored after an edit. Got %d", edited, mdb.StoredBytes())
+	}
+
+	//snapshots restore the same count, and deleting outright frees everything
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+	mdb.WriteSnapshot(dir)
+	restored := initEmptyDB()
+	restored.LoadSnapshot(dir)
+	if restored.StoredBytes() != edited {
+		t.Errorf("Expected %d bytes after restoring. Got %d", edited, restored.StoredBytes())
+	}
+	mdb.DeleteMessage("ID")
+	if mdb.StoredBytes() != 0 {
+		t.Errorf("Expected nothing stored after deleting. Got %d", mdb.StoredBytes())
+	}
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mdb := initPopulatedDB()
+	older, err := mdb.WriteSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	mdb.InsertMessage(&types.Message{ID: "D0000000-0000-0000-0000-000000000000", Text: "only in newest"})
+	newest, err := mdb.WriteSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+
+	//flip a byte in the middle of the newest snapshot
+	data, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := ioutil.WriteFile(newest, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := initEmptyDB()
+	path, err := restored.LoadSnapshot(dir)
+	if err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if path != older {
+		t.Errorf("Expected fallback to %s. Got %s", older, path)
+	}
+	contents, _ := restored.FetchAll()
+	if len(contents) != len(getTestMessages()) {
+		t.Errorf("Expected to restore %d messages, found %d", len(getTestMessages()), len(contents))
+	}
+}
+
+func TestPruneSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mdb := initPopulatedDB()
+	for i := 0; i < 4; i++ {
+		if _, err := mdb.WriteSnapshot(dir); err != nil {
+			t.Fatalf("Error writing snapshot: %s", err)
+		}
+	}
+	if err := PruneSnapshots(dir, 2); err != nil {
+		t.Fatalf("Error pruning snapshots: %s", err)
+	}
+	paths, _ := listSnapshots(dir)
+	if len(paths) != 2 {
+		t.Errorf("Expected 2 snapshots after pruning, found %d", len(paths))
+	}
+
+	empty, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(empty)
+	if _, err := initEmptyDB().LoadSnapshot(empty); err != ErrNoSnapshot {
+		t.Errorf("Expected ErrNoSnapshot from empty directory. Got %v", err)
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walcompact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+	size := func() int64 {
+		info, err := os.Stat(walPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	messages := getTestMessages()
+	mdb.InsertMessages(messages[:2])
+	older, _ := mdb.WriteSnapshot(dir)
+	mdb.InsertMessage(messages[2])
+	newest, _ := mdb.WriteSnapshot(dir)
+	before := size()
+	if err := mdb.compactWAL(dir); err != nil {
+		t.Fatalf("Error compacting WAL: %s", err)
+	}
+	if size() >= before {
+		t.Errorf("Expected the records held by both snapshots to be dropped. Got %d bytes, from %d", size(), before)
+	}
+	//appends after compaction go to the new log
+	if err := mdb.InsertMessage(messages[3]); err != nil {
+		t.Fatalf("Error inserting after compaction: %s", err)
+	}
+	mdb.Close()
+
+	restore := func(name string, expected string) {
+		t.Helper()
+		restored := initEmptyDB()
+		path, err := restored.LoadSnapshot(dir)
+		if err != nil || path != expected {
+			t.Fatalf("%s: expected to load %s. Got %s (%v)", name, expected, path, err)
+		}
+		if err := restored.OpenWAL(walPath); err != nil {
+			t.Fatalf("%s: error replaying WAL: %s", name, err)
+		}
+		defer restored.Close()
+		if contents, _ := restored.FetchAll(); len(contents) != 4 {
+			t.Errorf("%s: expected 4 messages. Got %d", name, len(contents))
+		}
+	}
+	restore("newest", newest)
+
+	//the log still reaches back to the older snapshot, if the newest is corrupt
+	data, _ := ioutil.ReadFile(newest)
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	ioutil.WriteFile(newest, corrupt, 0644)
+	restore("fallback", older)
+	ioutil.WriteFile(newest, data, 0644)
+
+	//once only the newest is kept, the log holds only what came after it
+	PruneSnapshots(dir, 1)
+	mdb = initEmptyDB()
+	mdb.LoadSnapshot(dir)
+	mdb.OpenWAL(walPath)
+	before = size()
+	if err := mdb.compactWAL(dir); err != nil || size() >= before {
+		t.Errorf("Expected a further compaction. Got %d bytes, from %d (%v)", size(), before, err)
+	}
+	mdb.Close()
+	restore("pruned", newest)
+
+	//a compacted log cannot be replayed without a snapshot
+	if err := initEmptyDB().OpenWAL(walPath); err != ErrWALGap {
+		t.Errorf("Expected ErrWALGap. Got %v", err)
+	}
+}
+
+func TestCreateMessage(t *testing.T) {
+	mdb := initPopulatedDB()
+	existing := getTestMessages()[0]
+
+	//the same message again is not stored twice
+	same := *existing
+	stored, created, err := mdb.CreateMessage(&same)
+	if err != nil || created || stored.Version != 1 {
+		t.Errorf("Expected the existing message back. Got %+v, %t, %v", stored, created, err)
+	}
+
+	//a different message with the ID is refused, leaving the stored one alone
+	different := *existing
+	different.Text = "overwritten"
+	if _, _, err := mdb.CreateMessage(&different); err != ErrConflict {
+		t.Errorf("Expected ErrConflict. Got %v", err)
+	}
+	if message, _ := mdb.FetchByID(existing.ID); message.Text != existing.Text || message.Version != 1 {
+		t.Errorf("Expected the stored message to be unchanged. Got %+v", message)
+	}
+
+	//a soft-deleted message keeps its ID
+	mdb.SetSoftDelete(true)
+	mdb.DeleteMessage(existing.ID)
+	same = *existing
+	if _, _, err := mdb.CreateMessage(&same); err != ErrConflict {
+		t.Errorf("Expected ErrConflict for a soft-deleted ID. Got %v", err)
+	}
+
+	fresh := &types.Message{ID: "NEW", Text: "new"}
+	if _, created, err := mdb.CreateMessage(fresh); err != nil || !created {
+		t.Errorf("Expected a new message to be created. Got %t, %v", created, err)
+	}
+	if message, err := mdb.FetchByID("NEW"); err != nil || message.Version != 1 {
+		t.Errorf("Expected the new message to be stored. Got %+v, %v", message, err)
+	}
+}
+
+func TestReviews(t *testing.T) {
+	mdb := initPopulatedDB()
+	before := mdb.StoredBytes()
+
+	held := &types.Message{ID: "HELD", Text: "cheap pills"}
+	review, ok, err := mdb.HoldMessage(held, []string{"blocked phrase \"pills\""})
+	if err != nil || !ok || review.Held == 0 || review.Decision != "" {
+		t.Fatalf("Expected the message to be held. Got %+v, %t, %v", review, ok, err)
+	}
+	if _, err := mdb.FetchByID("HELD"); err != ErrNotFound {
+		t.Errorf("Expected a held message not to be stored. Got %v", err)
+	}
+	if mdb.StoredBytes() <= before {
+		t.Errorf("Expected held messages to count towards the stored bytes")
+	}
+
+	//the ID is taken by the held message, whether posted again or not
+	same := *held
+	if _, ok, err := mdb.HoldMessage(&same, nil); err != nil || ok {
+		t.Errorf("Expected holding the same message again to do nothing. Got %t, %v", ok, err)
+	}
+	if _, _, err := mdb.CreateMessage(&same); err != ErrHeld {
+		t.Errorf("Expected ErrHeld. Got %v", err)
+	}
+	different := *held
+	different.Text = "something else"
+	if _, _, err := mdb.HoldMessage(&different, nil); err != ErrConflict {
+		t.Errorf("Expected ErrConflict holding a different message. Got %v", err)
+	}
+	if _, _, err := mdb.CreateMessage(&different); err != ErrConflict {
+		t.Errorf("Expected ErrConflict creating a different message. Got %v", err)
+	}
+
+	//so is the ID of a stored message
+	stored := *getTestMessages()[0]
+	if _, _, err := mdb.HoldMessage(&stored, nil); err != ErrStored {
+		t.Errorf("Expected ErrStored. Got %v", err)
+	}
+	stored.Text = "something else"
+	if _, _, err := mdb.HoldMessage(&stored, nil); err != ErrConflict {
+		t.Errorf("Expected ErrConflict holding over a stored message. Got %v", err)
+	}
+
+	mdb.HoldMessage(&types.Message{ID: "SPAM", Text: "spam"}, nil)
+	reviews, err := mdb.FetchReviews()
+	if err != nil || len(reviews) != 2 {
+		t.Fatalf("Expected 2 reviews. Got %d, %v", len(reviews), err)
+	}
+
+	decided, message, err := mdb.DecideReview("HELD", true, "admin")
+	if err != nil || decided.Decision != types.ReviewApproved || decided.DecidedBy != "admin" || message.Version != 1 {
+		t.Fatalf("Expected the message to be approved. Got %+v, %+v, %v", decided, message, err)
+	}
+	if message, err := mdb.FetchByID("HELD"); err != nil || message.Text != held.Text {
+		t.Errorf("Expected the approved message to be stored. Got %+v, %v", message, err)
+	}
+	if _, _, err := mdb.DecideReview("HELD", false, "admin"); err != ErrDecided {
+		t.Errorf("Expected ErrDecided. Got %v", err)
+	}
+	decided, message, err = mdb.DecideReview("SPAM", false, "admin")
+	if err != nil || decided.Decision != types.ReviewRejected || message != nil {
+		t.Errorf("Expected the message to be rejected. Got %+v, %+v, %v", decided, message, err)
+	}
+	if _, err := mdb.FetchByID("SPAM"); err != ErrNotFound {
+		t.Errorf("Expected a rejected message not to be stored. Got %v", err)
+	}
+	if _, _, err := mdb.DecideReview("MISSING", true, "admin"); err != ErrReviewNotFound {
+		t.Errorf("Expected ErrReviewNotFound. Got %v", err)
+	}
+}
+
+func TestReviewPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reviews")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	mdb.HoldMessage(&types.Message{ID: "PENDING", Text: "pending"}, []string{"3 links"})
+	mdb.HoldMessage(&types.Message{ID: "APPROVED", Text: "approved"}, nil)
+	mdb.HoldMessage(&types.Message{ID: "REJECTED", Text: "rejected"}, nil)
+	mdb.DecideReview("APPROVED", true, "admin")
+	mdb.DecideReview("REJECTED", false, "admin")
+
+	check := func(name string, restored *MessageDB) {
+		decisions := map[string]string{}
+		reviews, _ := restored.FetchReviews()
+		for _, review := range reviews {
+			decisions[review.ID] = review.Decision
+		}
+		if len(decisions) != 3 || decisions["PENDING"] != "" || decisions["APPROVED"] != types.ReviewApproved || decisions["REJECTED"] != types.ReviewRejected {
+			t.Errorf("%s: expected every review back. Got %v", name, decisions)
+		}
+		if review, err := restored.FetchReview("PENDING"); err != nil || len(review.Reasons) != 1 {
+			t.Errorf("%s: expected the reasons back. Got %+v, %v", name, review, err)
+		}
+		if _, err := restored.FetchByID("APPROVED"); err != nil {
+			t.Errorf("%s: expected the approved message back. Got %v", name, err)
+		}
+		if restored.StoredBytes() != mdb.StoredBytes() {
+			t.Errorf("%s: expected %d stored bytes. Got %d", name, mdb.StoredBytes(), restored.StoredBytes())
+		}
+	}
+
+	replayed := initEmptyDB()
+	if err := replayed.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer replayed.Close()
+	check("replay", replayed)
+
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	check("snapshot", restored)
+}
+
+func TestDeleteMessage(t *testing.T) {
+	mdb := initPopulatedDB()
+
+	if err := mdb.DeleteMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != nil {
+		t.Fatalf("Error deleting message: %s", err)
+	}
+	if _, err := mdb.FetchByID("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted message. Got %v", err)
+	}
+	if err := mdb.DeleteMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deleting twice. Got %v", err)
+	}
+	if err := mdb.RestoreMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound restoring a hard-deleted message. Got %v", err)
+	}
+	contents, _ := mdb.FetchAll()
+	if len(contents) != len(getTestMessages())-1 {
+		t.Errorf("Expected %d messages after delete, found %d", len(getTestMessages())-1, len(contents))
+	}
+}
+
+func TestSoftDeleteMessage(t *testing.T) {
+	mdb := initPopulatedDB()
+	mdb.SetSoftDelete(true)
+
+	if err := mdb.DeleteMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != nil {
+		t.Fatalf("Error deleting message: %s", err)
+	}
+	if _, err := mdb.FetchByID("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for soft-deleted message. Got %v", err)
+	}
+	messages, _ := mdb.FetchSortedByTime(0, math.MaxInt64, true)
+	if len(messages) != len(getTestMessages())-1 {
+		t.Errorf("Expected soft-deleted message to be hidden from time queries, found %d messages", len(messages))
+	}
+
+	if err := mdb.RestoreMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != nil {
+		t.Fatalf("Error restoring message: %s", err)
+	}
+	message, err := mdb.FetchByID("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A")
+	if err != nil || message.Name != "Alex Mustermann" {
+		t.Errorf("Error fetching restored message: %v", err)
+	}
+	if err := mdb.RestoreMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound restoring a live message. Got %v", err)
+	}
+}
+
+func TestWALReplayDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	mdb.InsertMessages(getTestMessages())
+	mdb.DeleteMessage("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A")
+	mdb.SetSoftDelete(true)
+	mdb.DeleteMessage("B4F7A417-424E-2B99-87B6-5CA0744B7BBD")
+	mdb.Close()
+
+	reopened := initEmptyDB()
+	if err := reopened.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer reopened.Close()
+	contents, _ := reopened.FetchAll()
+	if len(contents) != len(getTestMessages())-2 {
+		t.Errorf("Expected %d messages after replay, found %d", len(getTestMessages())-2, len(contents))
+	}
+	if err := reopened.RestoreMessage("B4F7A417-424E-2B99-87B6-5CA0744B7BBD"); err != nil {
+		t.Errorf("Expected soft-deleted message to survive replay: %s", err)
+	}
+}
+
+func TestFetchPage(t *testing.T) {
+	mdb := initPopulatedDB()
+	//two messages sharing a timestamp must still page deterministically
+	mdb.InsertMessages([]*types.Message{
+		{ID: "X1", Text: "tie", Time: 1500000000},
+		{ID: "X2", Text: "tie", Time: 1500000000},
+	})
+
+	var ids []string
+	var after *Cursor
+	for {
+		page, err := mdb.FetchPage(0, math.MaxInt64, false, after, 3)
+		if err != nil {
+			t.Fatalf("Error fetching page: %s", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, m := range page {
+			ids = append(ids, m.ID)
+		}
+		last := page[len(page)-1]
+		after = &Cursor{Time: last.Time, ID: last.ID}
+	}
+
+	all, _ := mdb.FetchSortedByTime(0, math.MaxInt64, false)
+	if len(ids) != len(all) {
+		t.Fatalf("Expected %d messages across pages, got %d", len(all), len(ids))
+	}
+	for i := range all {
+		if ids[i] != all[i].ID {
+			t.Errorf("Expected message %s at position %d, got %s", all[i].ID, i, ids[i])
+		}
+	}
+}
+
+func TestScanByTime(t *testing.T) {
+	mdb := initPopulatedDB()
+	//a message exactly on each bound must be included
+	mdb.InsertMessages([]*types.Message{
+		{ID: "X1", Text: "at start", Time: 1446754518},
+		{ID: "X2", Text: "at end", Time: 1554916209},
+	})
+
+	for _, ascending := range []bool{true, false} {
+		expected, _ := mdb.FetchSortedByTime(1446754518, 1554916209, ascending)
+		var scanned []*types.Message
+		err := mdb.ScanByTime(1446754518, 1554916209, ascending, func(m *types.Message) error {
+			scanned = append(scanned, m)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error scanning messages: %s", err)
+		}
+		if len(scanned) != 5 || len(scanned) != len(expected) {
+			t.Fatalf("Expected 5 scanned messages, got %d", len(scanned))
+		}
+		for i := range expected {
+			if scanned[i].ID != expected[i].ID {
+				t.Errorf("Expected message %s at position %d, got %s", expected[i].ID, i, scanned[i].ID)
+			}
+		}
+	}
+
+	//errors from the callback stop the scan
+	calls := 0
+	stop := errors.New("stop")
+	err := mdb.ScanByTime(0, math.MaxInt64, false, func(m *types.Message) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Expected scan to stop after first error. Got %v after %d calls", err, calls)
+	}
+}
+
+// initLargeDB builds a database of n messages, one second apart
+func initLargeDB(b *testing.B, n int) *MessageDB {
+	mdb := initEmptyDB()
+	batch := make([]*types.Message, 0, 1000)
+	for i := 0; i < n; i++ {
+		batch = append(batch, &types.Message{
+			ID:   fmt.Sprintf("%08X-0000-0000-0000-000000000000", i),
+			Text: "lorem ipsum",
+			Time: 1500000000 + int64(i),
+		})
+		if len(batch) == cap(batch) || i == n-1 {
+			if err := mdb.InsertMessages(batch); err != nil {
+				b.Fatal(err)
+			}
+			batch = make([]*types.Message, 0, 1000)
+		}
+	}
+	return mdb
+}
+
+// fetchSortedByTimeSort is the scan-filter-sort implementation of
+// FetchSortedByTime which index ordered iteration replaced, kept as a baseline
+func fetchSortedByTimeSort(m *MessageDB, start int64, end int64, ascending bool) []*types.Message {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+	it, _ := txn.LowerBound("message", "time", start)
+	var messages []*types.Message
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		m := obj.(*types.Message)
+		if m.Time <= end && m.DeletedAt == 0 {
+			messages = append(messages, m)
+		}
+	}
+	if ascending {
+		sort.Slice(messages, func(i, j int) bool { return lessByTime(messages[i], messages[j]) })
+	} else {
+		sort.Slice(messages, func(i, j int) bool { return lessByTime(messages[j], messages[i]) })
+	}
+	return messages
+}
+
+func benchmarkFetchSortedByTime(b *testing.B, window int64, ascending bool, baseline bool) {
+	const size = 200000
+	mdb := initLargeDB(b, size)
+	//a window at the start of the table, so the old scan has the most to walk past
+	start, end := int64(1500000000), int64(1500000000)+window-1
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var messages []*types.Message
+		if baseline {
+			messages = fetchSortedByTimeSort(mdb, start, end, ascending)
+		} else {
+			messages, _ = mdb.FetchSortedByTime(start, end, ascending)
+		}
+		if int64(len(messages)) != window {
+			b.Fatalf("Expected %d messages, got %d", window, len(messages))
+		}
+	}
+}
+
+func BenchmarkFetchSortedByTimeNarrowAsc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 1000, true, false)
+}
+
+func BenchmarkFetchSortedByTimeNarrowDesc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 1000, false, false)
+}
+
+func BenchmarkFetchSortedByTimeFullDesc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 200000, false, false)
+}
+
+func BenchmarkSortBaselineNarrowAsc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 1000, true, true)
+}
+
+func BenchmarkSortBaselineNarrowDesc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 1000, false, true)
+}
+
+func BenchmarkSortBaselineFullDesc(b *testing.B) {
+	benchmarkFetchSortedByTime(b, 200000, false, true)
+}
+
+func BenchmarkFetchPageDeep(b *testing.B) {
+	mdb := initLargeDB(b, 200000)
+	//a cursor half way down the table
+	after := &Cursor{Time: 1500100000, ID: fmt.Sprintf("%08X-0000-0000-0000-000000000000", 100000)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		page, _ := mdb.FetchPage(0, math.MaxInt64, false, after, 100)
+		if len(page) != 100 {
+			b.Fatalf("Expected 100 messages, got %d", len(page))
+		}
+	}
+}
+
+func searchDB(t *testing.T, mdb *MessageDB, raw string) []string {
+	q, err := search.ParseQuery(raw)
+	if err != nil {
+		t.Fatalf("Error parsing query %q: %s", raw, err)
+	}
+	results, err := mdb.Search(q, math.MinInt64, math.MaxInt64, 100)
+	if err != nil {
+		t.Fatalf("Error searching: %s", err)
+	}
+	var IDs []string
+	for _, result := range results {
+		IDs = append(IDs, result.Message.ID)
+	}
+	return IDs
+}
+
+func TestSearchFollowsWrites(t *testing.T) {
+	mdb := initPopulatedDB()
+
+	if IDs := searchDB(t, mdb, "isaac"); len(IDs) != 3 {
+		t.Errorf("Expected 3 messages from Isaac. Got %v", IDs)
+	}
+
+	//updates replace the indexed text
+	message, _ := mdb.FetchByID("2C7BCEC7-CD14-D6E5-3FBF-F9551375429A")
+	updated := *message
+	updated.Text = "rewritten entirely"
+	mdb.InsertMessage(&updated)
+	if IDs := searchDB(t, mdb, "testing"); len(IDs) != 0 {
+		t.Errorf("Expected old text to be gone from the index. Got %v", IDs)
+	}
+	if IDs := searchDB(t, mdb, "rewritten"); len(IDs) != 1 {
+		t.Errorf("Expected new text to be indexed. Got %v", IDs)
+	}
+
+	//deleted and soft-deleted messages are not found, restored ones are
+	mdb.DeleteMessage("A5D00000-7DE9-7E69-C311-763310C9AA54")
+	mdb.SetSoftDelete(true)
+	mdb.DeleteMessage("B5D11111-7DE9-7E69-C311-763310C9AA54")
+	if IDs := searchDB(t, mdb, "isaac"); len(IDs) != 1 {
+		t.Errorf("Expected deleted messages to be gone from the index. Got %v", IDs)
+	}
+	mdb.RestoreMessage("B5D11111-7DE9-7E69-C311-763310C9AA54")
+	if IDs := searchDB(t, mdb, "isaac"); len(IDs) != 2 {
+		t.Errorf("Expected restored message to be indexed. Got %v", IDs)
+	}
+
+	//time ranges filter the results
+	q, _ := search.ParseQuery("isaac")
+	results, _ := mdb.Search(q, 1546300800, math.MaxInt64, 100)
+	if len(results) != 1 || results[0].Message.ID != "C5D22222-7DE9-7E69-C311-763310C9AA54" {
+		t.Errorf("Expected only the 2019 message. Got %v", results)
+	}
+}
+
+func TestSearchAfterReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "searchreplay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mdb := initPopulatedDB()
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	if IDs := searchDB(t, restored, `"lorem ipsum"`); len(IDs) != 1 {
+		t.Errorf("Expected restored messages to be indexed. Got %v", IDs)
+	}
+}
+
+func TestFetchBySender(t *testing.T) {
+	mdb := initPopulatedDB()
+	mdb.InsertMessage(&types.Message{ID: "X1", Name: "Isaac Wilder", Email: "Name@Fake.Domain", Text: "shouting", Time: 1600000000})
+	mdb.InsertMessage(&types.Message{ID: "X2", Text: "anonymous", Time: 1600000001})
+
+	messages, err := mdb.FetchByEmail("NAME@fake.domain", false, nil, 10)
+	if err != nil {
+		t.Fatalf("Error fetching by email: %s", err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("Expected 4 messages from name@fake.domain in any case, got %d", len(messages))
+	}
+	if messages[0].ID != "X1" {
+		t.Errorf("Expected latest message first, got %s", messages[0].ID)
+	}
+	var times []int64
+	for _, m := range messages {
+		times = append([]int64{m.Time}, times...)
+	}
+	if !sort.IsSorted(types.Int64Slice(times)) {
+		t.Errorf("Results not sorted reverse chronologically")
+	}
+
+	messages, _ = mdb.FetchByEmailPrefix("FAKE@", true, nil, 10)
+	if len(messages) != 1 || messages[0].Name != "Alex Mustermann" {
+		t.Errorf("Expected one message with prefix fake@, got %d", len(messages))
+	}
+	messages, _ = mdb.FetchByEmailPrefix("name@", false, nil, 2)
+	if len(messages) != 2 || messages[0].ID != "X1" {
+		t.Errorf("Expected the latest 2 messages with prefix name@, got %d", len(messages))
+	}
+
+	messages, _ = mdb.FetchByName("Isaac Wilder", true, nil, 10)
+	if len(messages) != 4 || messages[0].ID != "A5D00000-7DE9-7E69-C311-763310C9AA54" {
+		t.Errorf("Expected 4 messages from Isaac Wilder, earliest first, got %d", len(messages))
+	}
+	messages, _ = mdb.FetchByName("isaac wilder", true, nil, 10)
+	if len(messages) != 0 {
+		t.Errorf("Expected name lookups to be exact, got %d", len(messages))
+	}
+
+	//soft-deleted messages are hidden
+	mdb.SetSoftDelete(true)
+	mdb.DeleteMessage("X1")
+	messages, _ = mdb.FetchByEmail("name@fake.domain", false, nil, 10)
+	if len(messages) != 3 {
+		t.Errorf("Expected soft-deleted message to be hidden, got %d messages", len(messages))
+	}
+
+	page, _ := mdb.FetchByEmail("name@fake.domain", false, &Cursor{Time: messages[0].Time, ID: messages[0].ID}, 1)
+	if len(page) != 1 || page[0].ID != messages[1].ID {
+		t.Errorf("Expected page after the first message to hold the second")
+	}
+
+	//messages with a longer address sharing the start stay out of the sender's pages
+	mdb.InsertMessage(&types.Message{ID: "X3", Email: "name@fake.domain.org", Text: "other", Time: 1600000002})
+	messages, _ = mdb.FetchByEmail("name@fake.domain", false, nil, 10)
+	if len(messages) != 3 {
+		t.Errorf("Expected only exact addresses, got %d messages", len(messages))
+	}
+}
+
+func TestAPIKeyPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initPopulatedDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	keys := []*types.APIKey{
+		{ID: "k1", Name: "first", Hash: []byte("h1"), Scopes: []string{"read"}, Created: 100},
+		{ID: "k2", Name: "second", Hash: []byte("h2"), Scopes: []string{"read", "write"}, Created: 200, Expires: 300},
+	}
+	for _, key := range keys {
+		if err := mdb.InsertAPIKey(key); err != nil {
+			t.Fatalf("Error inserting key: %s", err)
+		}
+	}
+	if err := mdb.RevokeAPIKey("k1", 150); err != nil {
+		t.Fatalf("Error revoking key: %s", err)
+	}
+	if err := mdb.RevokeAPIKey("k1", 160); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound revoking twice. Got %v", err)
+	}
+	if err := mdb.RevokeAPIKey("missing", 160); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound revoking a missing key. Got %v", err)
+	}
+
+	check := func(name string, restored *MessageDB) {
+		all, err := restored.FetchAPIKeys()
+		if err != nil || len(all) != 2 {
+			t.Fatalf("%s: expected 2 keys. Got %d (%v)", name, len(all), err)
+		}
+		k1, err := restored.FetchAPIKey("k1")
+		if err != nil || k1.Revoked != 150 {
+			t.Errorf("%s: expected k1 revoked at 150. Got %+v (%v)", name, k1, err)
+		}
+		k2, err := restored.FetchAPIKey("k2")
+		if err != nil || k2.Expires != 300 || string(k2.Hash) != "h2" || len(k2.Scopes) != 2 {
+			t.Errorf("%s: expected k2 intact. Got %+v (%v)", name, k2, err)
+		}
+		if _, err := restored.FetchAPIKey("missing"); err != ErrKeyNotFound {
+			t.Errorf("%s: expected ErrKeyNotFound. Got %v", name, err)
+		}
+	}
+
+	replayed := initEmptyDB()
+	if err := replayed.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer replayed.Close()
+	check("replay", replayed)
+
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	check("snapshot", restored)
+	if contents, _ := restored.FetchAll(); len(contents) != len(getTestMessages()) {
+		t.Errorf("Expected %d messages alongside the keys, found %d", len(getTestMessages()), len(contents))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initPopulatedDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	ID := "A5D00000-7DE9-7E69-C311-763310C9AA54"
+
+	//an audited edit and delete each record the message before and after
+	edit := &Audit{Entry: types.AuditEntry{Principal: "alice", Method: "PUT", Route: "/private/message"}}
+	original, _ := mdb.FetchByID(ID)
+	updated := *original
+	updated.Text = "edited"
+	if err := mdb.WithAudit(edit).InsertMessage(&updated); err != nil {
+		t.Fatalf("Error updating message: %s", err)
+	}
+	if edit.Written != 1 {
+		t.Errorf("Expected 1 entry written for the edit. Got %d", edit.Written)
+	}
+	remove := &Audit{Entry: types.AuditEntry{Principal: "bob", Method: "DELETE", Route: "/private/message/{id}"}}
+	if err := mdb.WithAudit(remove).DeleteMessage(ID); err != nil {
+		t.Fatalf("Error deleting message: %s", err)
+	}
+	//a failed write records nothing
+	missing := &Audit{Entry: types.AuditEntry{Principal: "bob", Method: "DELETE"}}
+	if err := mdb.WithAudit(missing).DeleteMessage("missing"); err != ErrNotFound || missing.Written != 0 {
+		t.Errorf("Expected nothing written for a missing message. Got %v, %d", err, missing.Written)
+	}
+	if err := mdb.InsertAudit(&types.AuditEntry{Principal: "alice", Method: "GET", Route: "/private/dump", Status: 200}); err != nil {
+		t.Fatalf("Error inserting audit entry: %s", err)
+	}
+
+	check := func(name string, restored *MessageDB) {
+		entries, err := restored.FetchAudit(AuditFilter{MessageID: ID}, true, 0, 10)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("%s: expected 2 entries for the message. Got %d (%v)", name, len(entries), err)
+		}
+		if entries[0].Old.Text != "hi there" || entries[0].New.Text != "edited" || entries[0].Principal != "alice" {
+			t.Errorf("%s: expected the edit to record old and new text. Got %+v", name, entries[0])
+		}
+		if entries[1].Old.Text != "edited" || entries[1].New != nil || entries[1].Seq <= entries[0].Seq {
+			t.Errorf("%s: expected the delete to record the old text only. Got %+v", name, entries[1])
+		}
+
+		all, _ := restored.FetchAudit(AuditFilter{}, false, 0, 10)
+		if len(all) != 3 || all[0].Route != "/private/dump" || all[0].Status != 200 {
+			t.Errorf("%s: expected 3 entries, newest first. Got %v", name, all)
+		}
+		byPrincipal, _ := restored.FetchAudit(AuditFilter{Principal: "alice"}, false, 0, 10)
+		if len(byPrincipal) != 2 || byPrincipal[0].Seq != all[0].Seq {
+			t.Errorf("%s: expected alice's 2 entries, newest first. Got %v", name, byPrincipal)
+		}
+		page, _ := restored.FetchAudit(AuditFilter{}, false, all[0].Seq, 1)
+		if len(page) != 1 || page[0].Seq != all[1].Seq {
+			t.Errorf("%s: expected the entry after the cursor. Got %v", name, page)
+		}
+		page, _ = restored.FetchAudit(AuditFilter{Method: "DELETE"}, true, all[2].Seq, 10)
+		if len(page) != 1 || page[0].Principal != "bob" {
+			t.Errorf("%s: expected bob's delete. Got %v", name, page)
+		}
+	}
+	check("live", mdb)
+
+	replayed := initPopulatedDB()
+	if err := replayed.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer replayed.Close()
+	check("replay", replayed)
+
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	check("snapshot", restored)
+
+	//new entries carry on numbering after the restored ones
+	restored.InsertAudit(&types.AuditEntry{Principal: "carol"})
+	latest, _ := restored.FetchAudit(AuditFilter{}, false, 0, 1)
+	if len(latest) != 1 || latest[0].Seq != 4 {
+		t.Errorf("Expected the next entry to be numbered 4. Got %v", latest)
+	}
+}
+
+func TestAuditRetention(t *testing.T) {
+	mdb := initEmptyDB()
+	mdb.SetAuditRetention(time.Hour, 3)
+	empty := mdb.StoredBytes()
+
+	//entries older than the retention go first
+	mdb.InsertAudit(&types.AuditEntry{Principal: "old", Time: time.Now().Add(-2 * time.Hour).UnixNano()})
+	mdb.InsertAudit(&types.AuditEntry{Principal: "alice"})
+	entries, _ := mdb.FetchAudit(AuditFilter{}, true, 0, 10)
+	if len(entries) != 1 || entries[0].Principal != "alice" {
+		t.Errorf("Expected the expired entry to be dropped. Got %v", entries)
+	}
+
+	//then the oldest, beyond the most entries kept
+	for i := 0; i < 4; i++ {
+		mdb.InsertAudit(&types.AuditEntry{Principal: "bob", Old: &types.Message{ID: "A", Text: "some text"}})
+	}
+	entries, _ = mdb.FetchAudit(AuditFilter{}, true, 0, 10)
+	if len(entries) != 3 || entries[0].Seq != 4 || entries[2].Seq != 6 {
+		t.Errorf("Expected the 3 newest entries. Got %v", entries)
+	}
+
+	//the entries kept count towards the stored bytes, and dropped ones do not
+	kept := mdb.StoredBytes() - empty
+	var expected int64
+	for _, entry := range entries {
+		expected += auditSize(entry)
+	}
+	if kept != expected {
+		t.Errorf("Expected the audit log to take %d bytes. Got %d", expected, kept)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revisions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	mdb.SetSoftDelete(true)
+	messages := getTestMessages()
+	if err := mdb.InsertMessages(messages); err != nil {
+		t.Fatalf("Error inserting messages: %s", err)
+	}
+	ID := messages[0].ID
+	for _, text := range []string{"second", "third"} {
+		current, _ := mdb.FetchByID(ID)
+		edited := *current
+		edited.Text = text
+		if err := mdb.InsertMessage(&edited); err != nil {
+			t.Fatalf("Error editing message: %s", err)
+		}
+	}
+
+	current, _ := mdb.FetchByID(ID)
+	if current.Version != 3 || current.CreatedAt == 0 || current.UpdatedAt < current.CreatedAt {
+		t.Errorf("Expected version 3 with bookkeeping times. Got %+v", current)
+	}
+	revisions, err := mdb.FetchRevisions(ID)
+	if err != nil || len(revisions) != 3 {
+		t.Fatalf("Expected 3 revisions. Got %d (%v)", len(revisions), err)
+	}
+	for i, text := range []string{"hi there", "second", "third"} {
+		if revisions[i].Version != i+1 || revisions[i].Text != text {
+			t.Errorf("Expected revision %d to be %q. Got %+v", i+1, text, revisions[i])
+		}
+	}
+	if _, err := mdb.FetchRevision(ID, 4); err != ErrRevisionNotFound {
+		t.Errorf("Expected ErrRevisionNotFound. Got %v", err)
+	}
+
+	//rolling back stores the old content as a new version
+	rolledBack, err := mdb.RollbackMessage(ID, 1)
+	if err != nil || rolledBack.Version != 4 || rolledBack.Text != "hi there" || rolledBack.CreatedAt != current.CreatedAt {
+		t.Errorf("Expected version 4 with the original text. Got %+v (%v)", rolledBack, err)
+	}
+	if message, _ := mdb.FetchByID(ID); message.Text != "hi there" {
+		t.Errorf("Expected the rollback to be stored. Got %q", message.Text)
+	}
+	if _, err := mdb.RollbackMessage("missing", 1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound rolling back a missing message. Got %v", err)
+	}
+
+	//soft deletion hides the history without adding to it
+	mdb.DeleteMessage(ID)
+	if _, err := mdb.FetchRevisions(ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted message. Got %v", err)
+	}
+	mdb.RestoreMessage(ID)
+	if revisions, _ := mdb.FetchRevisions(ID); len(revisions) != 4 {
+		t.Errorf("Expected 4 revisions after restoring. Got %d", len(revisions))
+	}
+
+	check := func(name string, restored *MessageDB) {
+		revisions, err := restored.FetchRevisions(ID)
+		if err != nil || len(revisions) != 4 || revisions[1].Text != "second" || revisions[3].Version != 4 {
+			t.Errorf("%s: expected 4 revisions. Got %v (%v)", name, revisions, err)
+		}
+	}
+	replayed := initEmptyDB()
+	if err := replayed.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer replayed.Close()
+	check("replay", replayed)
+	if _, err := mdb.WriteSnapshot(dir); err != nil {
+		t.Fatalf("Error writing snapshot: %s", err)
+	}
+	restored := initEmptyDB()
+	if _, err := restored.LoadSnapshot(dir); err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+	check("snapshot", restored)
+
+	//hard deletion removes the history with the message
+	restored.SetSoftDelete(false)
+	restored.DeleteMessage(ID)
+	restored.InsertMessage(getTestMessages()[0])
+	if revisions, _ := restored.FetchRevisions(ID); len(revisions) != 1 || revisions[0].Version != 1 {
+		t.Errorf("Expected a fresh history after a hard delete. Got %v", revisions)
+	}
+}
+
+func TestMessageStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walPath := filepath.Join(dir, "messages.wal")
+
+	mdb := initEmptyDB()
+	if err := mdb.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error opening WAL: %s", err)
+	}
+	messages := getTestMessages()
+	mdb.InsertMessages(messages)
+	for _, m := range messages {
+		if m.Status != types.StatusNew {
+			t.Errorf("Expected %s to start out new. Got %q", m.ID, m.Status)
+		}
+	}
+	first, second, third := messages[0].ID, messages[1].ID, messages[2].ID
+
+	stored := mdb.StoredBytes()
+	moved, err := mdb.SetStatus([]string{first, second}, types.StatusRead, nil)
+	if err != nil || len(moved) != 2 || moved[0].Status != types.StatusRead || moved[0].Version != 1 {
+		t.Fatalf("Expected both messages to be read, keeping their versions. Got %v (%v)", moved, err)
+	}
+	//a move is not an edit, so keeps no revision
+	if revisions, _ := mdb.FetchRevisions(first); len(revisions) != 1 || mdb.StoredBytes() != stored {
+		t.Errorf("Expected no revision for the move. Got %d revisions, %d bytes from %d", len(revisions), mdb.StoredBytes(), stored)
+	}
+	//moving to the same status stores nothing
+	if again, err := mdb.SetStatus([]string{first}, types.StatusRead, nil); err != nil || again[0].Version != 1 {
+		t.Errorf("Expected an unchanged message. Got %v (%v)", again, err)
+	}
+	mdb.SetStatus([]string{first}, types.StatusReplied, nil)
+
+	//a bulk move is all or nothing
+	_, err = mdb.SetStatus([]string{second, first, third}, types.StatusNew, nil)
+	if e, ok := err.(*StatusError); !ok || e.Err != ErrTransition || e.ID != first || e.From != types.StatusReplied {
+		t.Errorf("Expected a transition error naming the replied message. Got %v", err)
+	}
+	if m, _ := mdb.FetchByID(second); m.Status != types.StatusRead {
+		t.Errorf("Expected the refused move to change nothing. Got %q", m.Status)
+	}
+	_, err = mdb.SetStatus([]string{second, "missing"}, types.StatusArchived, nil)
+	if e, ok := err.(*StatusError); !ok || e.Err != ErrNotFound || e.ID != "missing" {
+		t.Errorf("Expected a not found error naming the missing message. Got %v", err)
+	}
+	_, err = mdb.SetStatus([]string{second}, types.StatusArchived, func(*types.Message) bool { return false })
+	if e, ok := err.(*StatusError); !ok || e.Err != ErrPreconditionFailed {
+		t.Errorf("Expected a failed precondition. Got %v", err)
+	}
+
+	//rolling back the content keeps the status
+	mdb.UpdateMessage(first, nil, func(m *types.Message) error {
+		m.Text = "edited"
+		return nil
+	})
+	if rolledBack, err := mdb.RollbackMessage(first, 1); err != nil || rolledBack.Status != types.StatusReplied {
+		t.Errorf("Expected the rollback to stay replied. Got %v (%v)", rolledBack, err)
+	}
+
+	check := func(name string, mdb *MessageDB) {
+		t.Helper()
+		var ids []string
+		mdb.ScanByStatus(types.StatusNew, 0, math.MaxInt64, false, func(m *types.Message) error {
+			ids = append(ids, m.ID)
+			return nil
+		})
+		if len(ids) != 3 || ids[0] != messages[4].ID || ids[2] != third {
+			t.Errorf("%s: expected the new messages, latest first. Got %v", name, ids)
+		}
+		page, _ := mdb.FetchStatusPage(types.StatusNew, 0, messages[3].Time, true, &Cursor{Time: messages[2].Time, ID: third}, 10)
+		if len(page) != 1 || page[0].ID != messages[3].ID {
+			t.Errorf("%s: expected one new message in the window past the cursor. Got %v", name, page)
+		}
+		if page, _ := mdb.FetchStatusPage(types.StatusRead, 0, math.MaxInt64, true, nil, 10); len(page) != 1 || page[0].ID != second {
+			t.Errorf("%s: expected one read message. Got %v", name, page)
+		}
+		if page, _ := mdb.FetchStatusPage(types.StatusArchived, 0, math.MaxInt64, true, nil, 10); len(page) != 0 {
+			t.Errorf("%s: expected no archived messages. Got %v", name, page)
+		}
+	}
+	check("live", mdb)
+	replayed := initEmptyDB()
+	if err := replayed.OpenWAL(walPath); err != nil {
+		t.Fatalf("Error reopening WAL: %s", err)
+	}
+	defer replayed.Close()
+	check("replay", replayed)
+
+	//messages logged before they had a status are new
+	legacy := *getTestMessages()[0]
+	legacy.ID = "legacy"
+	legacy.Version = 1
+	if err := replayed.applyRecord(&walRecord{Op: walOpInsert, Messages: []*types.Message{&legacy}}); err != nil {
+		t.Fatalf("Error applying record: %s", err)
+	}
+	if m, _ := replayed.FetchByID("legacy"); m.Status != types.StatusNew {
+		t.Errorf("Expected a replayed message without a status to be new. Got %q", m.Status)
+	}
+}
+
+func TestUpdateMessageConcurrent(t *testing.T) {
+	mdb := initPopulatedDB()
+	ID := getTestMessages()[0].ID
+	mdb.UpdateMessage(ID, nil, func(message *types.Message) error {
+		message.Text = "0"
+		return nil
+	})
+
+	//each writer reads the counter, then writes it back incremented only if
+	//nobody else wrote in between, retrying when they did
+	const writers, increments = 20, 25
+	var wg sync.WaitGroup
+	var conflicts int64
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				read, err := mdb.FetchByID(ID)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(read.Text)
+				_, err = mdb.UpdateMessage(ID, func(current *types.Message) bool {
+					return current.Version == read.Version
+				}, func(message *types.Message) error {
+					message.Text = strconv.Itoa(n + 1)
+					return nil
+				})
+				if err == ErrPreconditionFailed {
+					atomic.AddInt64(&conflicts, 1)
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	final, _ := mdb.FetchByID(ID)
+	if final.Text != strconv.Itoa(writers*increments) || final.Version != writers*increments+2 {
+		t.Errorf("Expected %d increments and version %d. Got %q at version %d (%d conflicts)",
+			writers*increments, writers*increments+2, final.Text, final.Version, conflicts)
+	}
+	if _, err := mdb.UpdateMessage("missing", nil, func(*types.Message) error { return nil }); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+	failed := errors.New("update failed")
+	if _, err := mdb.UpdateMessage(ID, nil, func(message *types.Message) error {
+		message.Text = "discarded"
+		return failed
+	}); err != failed {
+		t.Errorf("Expected the update's error. Got %v", err)
+	}
+	if message, _ := mdb.FetchByID(ID); message.Text == "discarded" || message.Version != final.Version {
+		t.Errorf("Expected a failed update to store nothing. Got %+v", message)
+	}
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/imw-challenge/back/types"
+)
+
+// ErrReviewNotFound is returned when no message with an ID is held for review
+var ErrReviewNotFound = errors.New("Review not found")
+
+// ErrDecided is returned when deciding a review which was already decided
+var ErrDecided = errors.New("Review already decided")
+
+// ErrHeld is returned when creating a message which is already held for
+// review, or was rejected, with the same content
+var ErrHeld = errors.New("Message is held for review")
+
+// ErrStored is returned when holding a message which is already stored with
+// the same content
+var ErrStored = errors.New("Message is already stored")
+
+// HoldMessage keeps a new message for review instead of storing it, along
+// with the reasons it was held. If a message with its ID is already held with
+// the same content, nothing is kept and that review is returned with held
+// false. If it is already stored, ErrStored is returned if the content is the
+// same, and otherwise ErrConflict, as for CreateMessage
+func (m *MessageDB) HoldMessage(message *types.Message, reasons []string) (*types.Review, bool, error) {
+	txn := m.writeTxn()
+
+	if err := checkStored(txn, message); err != nil {
+		txn.Abort()
+		return nil, false, err
+	}
+	existing, err := fetchReview(txn, message.ID)
+	if err != nil && err != ErrReviewNotFound {
+		txn.Abort()
+		return nil, false, err
+	}
+	if existing != nil {
+		txn.Abort()
+		if !sameContent(existing.Message, message) {
+			return nil, false, ErrConflict
+		}
+		return existing, false, nil
+	}
+
+	review := &types.Review{ID: message.ID, Message: message, Reasons: reasons, Held: time.Now().Unix()}
+	if err := txn.Insert("review", review); err != nil {
+		txn.Abort()
+		return nil, false, err
+	}
+	if err := m.commit(txn, &walRecord{Op: walOpReview, Reviews: []*types.Review{review}}); err != nil {
+		return nil, false, err
+	}
+	return review, true, nil
+}
+
+// checkStored returns ErrStored if a message is already stored with the same
+// content, or ErrConflict if its ID is taken by a different or deleted message
+func checkStored(txn *memdb.Txn, message *types.Message) error {
+	raw, err := txn.First("message", "id", message.ID)
+	if err != nil || raw == nil {
+		return err
+	}
+	existing := raw.(*types.Message)
+	if existing.DeletedAt != 0 || !sameContent(existing, message) {
+		return ErrConflict
+	}
+	return ErrStored
+}
+
+// checkHeld returns ErrHeld if a message is held for review, or was rejected,
+// with the same content, or ErrConflict if its ID is held by a different message
+func checkHeld(txn *memdb.Txn, message *types.Message) error {
+	review, err := fetchReview(txn, message.ID)
+	if err == ErrReviewNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !sameContent(review.Message, message) {
+		return ErrConflict
+	}
+	return ErrHeld
+}
+
+// FetchReview fetches the review of a held message by the message's ID
+func (m *MessageDB) FetchReview(ID string) (*types.Review, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+	return fetchReview(txn, ID)
+}
+
+func fetchReview(txn *memdb.Txn, ID string) (*types.Review, error) {
+	raw, err := txn.First("review", "id", ID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, ErrReviewNotFound
+	}
+	return raw.(*types.Review), nil
+}
+
+// FetchReviews returns every review, pending and decided, in the order the
+// messages were held
+func (m *MessageDB) FetchReviews() ([]*types.Review, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	it, err := txn.Get("review", "id")
+	if err != nil {
+		return nil, err
+	}
+	var reviews []*types.Review
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		reviews = append(reviews, obj.(*types.Review))
+	}
+	sort.Slice(reviews, func(i, j int) bool {
+		if reviews[i].Held != reviews[j].Held {
+			return reviews[i].Held < reviews[j].Held
+		}
+		return reviews[i].ID < reviews[j].ID
+	})
+	return reviews, nil
+}
+
+// DecideReview approves or rejects a held message, returning the decided
+// review. An approved message is stored as new, and returned as stored; a
+// rejected one is only kept in its review. It returns ErrReviewNotFound if no
+// such message is held, ErrDecided if it was already decided, and ErrConflict
+// if a message with its ID has been stored since it was held
+func (m *MessageDB) DecideReview(ID string, approve bool, by string) (*types.Review, *types.Message, error) {
+	txn := m.writeTxn()
+
+	review, err := fetchReview(txn, ID)
+	if err != nil {
+		txn.Abort()
+		return nil, nil, err
+	}
+	if review.Decision != "" {
+		txn.Abort()
+		return nil, nil, ErrDecided
+	}
+
+	now := time.Now().Unix()
+	decided := *review
+	decided.Decision = types.ReviewRejected
+	decided.Decided = now
+	decided.DecidedBy = by
+	rec := &walRecord{Op: walOpReview, Reviews: []*types.Review{&decided}}
+
+	var stored *types.Message
+	if approve {
+		decided.Decision = types.ReviewApproved
+		raw, err := txn.First("message", "id", ID)
+		if err != nil || raw != nil {
+			txn.Abort()
+			if err == nil {
+				err = ErrConflict
+			}
+			return nil, nil, err
+		}
+		message := *review.Message
+		if err := m.putMessage(txn, &message, now); err != nil {
+			txn.Abort()
+			return nil, nil, err
+		}
+		stored = &message
+		rec.Op = walOpInsert
+		rec.Messages = []*types.Message{stored}
+	}
+	if err := txn.Insert("review", &decided); err != nil {
+		txn.Abort()
+		return nil, nil, err
+	}
+	if err := m.commit(txn, rec); err != nil {
+		return nil, nil, err
+	}
+	return &decided, stored, nil
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/imw-challenge/back/types"
+)
+
+// ErrRevisionNotFound is returned when a message has no revision with the version asked for
+var ErrRevisionNotFound = errors.New("Revision not found")
+
+// putMessage stamps a message with its version and stores it, keeping the
+// new version as a revision
+func (m *MessageDB) putMessage(txn *memdb.Txn, message *types.Message, now int64) error {
+	if err := stampVersion(txn, message, now); err != nil {
+		return err
+	}
+	if err := txn.Insert("message", message); err != nil {
+		return err
+	}
+	return putRevision(txn, message)
+}
+
+// stampVersion sets the version and bookkeeping times of a message about to
+// replace the stored message with its ID, if there is one. A message given no
+// status keeps the stored message's, or else is new
+func stampVersion(txn *memdb.Txn, message *types.Message, now int64) error {
+	raw, err := txn.First("message", "id", message.ID)
+	if err != nil {
+		return err
+	}
+	message.Version = 1
+	message.CreatedAt = now
+	if raw != nil {
+		existing := raw.(*types.Message)
+		message.Version = existing.Version + 1
+		message.CreatedAt = existing.CreatedAt
+		if message.Status == "" {
+			message.Status = existing.Status
+		}
+	}
+	if message.Status == "" {
+		message.Status = types.StatusNew
+	}
+	message.UpdatedAt = now
+	return nil
+}
+
+// putRevision keeps a version of a message, unless it is already kept
+// soft deletion and restoration do not change the version, so are not revisions
+func putRevision(txn *memdb.Txn, message *types.Message) error {
+	existing, err := txn.First("revision", "id", message.ID, message.Version)
+	if err != nil || existing != nil {
+		return err
+	}
+	revision := message
+	if message.DeletedAt != 0 {
+		undeleted := *message
+		undeleted.DeletedAt = 0
+		revision = &undeleted
+	}
+	return txn.Insert("revision", revision)
+}
+
+// liveMessage returns the stored message with an ID, or ErrNotFound if it is
+// missing or soft-deleted
+func liveMessage(txn *memdb.Txn, ID string) (*types.Message, error) {
+	raw, err := txn.First("message", "id", ID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil || raw.(*types.Message).DeletedAt != 0 {
+		return nil, ErrNotFound
+	}
+	return raw.(*types.Message), nil
+}
+
+// FetchRevisions returns every version of a message, oldest first, or
+// ErrNotFound if the message does not exist or is soft-deleted
+func (m *MessageDB) FetchRevisions(ID string) ([]*types.Message, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	if _, err := liveMessage(txn, ID); err != nil {
+		return nil, err
+	}
+	//the index orders each message's revisions by version
+	it, err := txn.Get("revision", "message", ID)
+	if err != nil {
+		return nil, err
+	}
+	var revisions []*types.Message
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		revisions = append(revisions, obj.(*types.Message))
+	}
+	return revisions, nil
+}
+
+// FetchRevision returns one version of a message, ErrNotFound if the message
+// does not exist or is soft-deleted, or ErrRevisionNotFound if it has no such version
+func (m *MessageDB) FetchRevision(ID string, version int) (*types.Message, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	if _, err := liveMessage(txn, ID); err != nil {
+		return nil, err
+	}
+	return fetchRevision(txn, ID, version)
+}
+
+func fetchRevision(txn *memdb.Txn, ID string, version int) (*types.Message, error) {
+	raw, err := txn.First("revision", "id", ID, version)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, ErrRevisionNotFound
+	}
+	return raw.(*types.Message), nil
+}
+
+// RollbackMessage stores the content of an earlier version of a message as
+// its newest version, returning the message as stored. Later versions are kept,
+// so a rollback can itself be rolled back
+func (m *MessageDB) RollbackMessage(ID string, version int) (*types.Message, error) {
+	txn := m.writeTxn()
+
+	current, err := liveMessage(txn, ID)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	revision, err := fetchRevision(txn, ID, version)
+	if err != nil {
+		txn.Abort()
+		return nil, err
+	}
+
+	//only the content is rolled back, the message stays in its status
+	rolledBack := *revision
+	rolledBack.Status = current.Status
+	if err := m.putMessage(txn, &rolledBack, time.Now().Unix()); err != nil {
+		txn.Abort()
+		return nil, err
+	}
+	if err := m.commit(txn, &walRecord{Op: walOpInsert, Messages: []*types.Message{&rolledBack}}); err != nil {
+		return nil, err
+	}
+	return &rolledBack, nil
+}
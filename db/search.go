@@ -0,0 +1,62 @@
+package db
+
+import (
+	"github.com/hashicorp/go-memdb"
+	"github.com/imw-challenge/back/search"
+	"github.com/imw-challenge/back/types"
+)
+
+// SearchResult is a message matching a search, with its relevance score
+type SearchResult struct {
+	Message *types.Message
+	Score   float64
+}
+
+// Search returns up to limit messages matching q with timestamps between
+// start and end (inclusive), most relevant first
+func (m *MessageDB) Search(q *search.Query, start int64, end int64, limit int) ([]SearchResult, error) {
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+
+	var results []SearchResult
+	for _, hit := range m.index.Search(q) {
+		raw, err := txn.First("message", "id", hit.ID)
+		if err != nil {
+			return []SearchResult{}, err
+		}
+		//the index may briefly be ahead of this read transaction
+		if raw == nil {
+			continue
+		}
+		message := raw.(*types.Message)
+		if message.DeletedAt != 0 || message.Time < start || message.Time > end {
+			continue
+		}
+		results = append(results, SearchResult{Message: message, Score: hit.Score})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+// updateIndex applies the changes made in txn to the search index
+// it is called while txn still holds the write lock, so that updates
+// reach the index in the same order as they reach the database
+func (m *MessageDB) updateIndex(txn *memdb.Txn) {
+	for _, change := range txn.Changes() {
+		if change.Table != "message" {
+			continue
+		}
+		if change.Deleted() {
+			m.index.Remove(change.Before.(*types.Message).ID)
+			continue
+		}
+		message := change.After.(*types.Message)
+		if message.DeletedAt != 0 {
+			m.index.Remove(message.ID)
+			continue
+		}
+		m.index.Add(message.ID, message.Name, message.Email, message.Text)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"sync/atomic"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/imw-challenge/back/types"
+)
+
+// messageOverhead roughly accounts for the struct and index entries of each
+// stored message or revision, on top of its strings
+const messageOverhead = 256
+
+// messageSize estimates the memory a stored message or revision takes
+func messageSize(message *types.Message) int64 {
+	return int64(len(message.ID)+len(message.Name)+len(message.Email)+len(message.Text)) + messageOverhead
+}
+
+// NewMessageSize estimates the memory storing message as a new message takes,
+// with its first revision, as StoredBytes counts it
+func NewMessageSize(message *types.Message) int64 {
+	return 2 * messageSize(message)
+}
+
+// auditSize estimates the memory an audit entry takes, with the copies of the
+// message before and after the change it records
+func auditSize(entry *types.AuditEntry) int64 {
+	size := int64(len(entry.Principal)+len(entry.Method)+len(entry.Route)+len(entry.MessageID)+
+		len(entry.ClientIP)+len(entry.RequestID)) + messageOverhead
+	if entry.Old != nil {
+		size += messageSize(entry.Old)
+	}
+	if entry.New != nil {
+		size += messageSize(entry.New)
+	}
+	return size
+}
+
+// StoredBytes estimates the memory taken by the stored messages, including
+// soft-deleted ones, their revisions, the messages held for review, and the
+// audit log
+func (m *MessageDB) StoredBytes() int64 {
+	return atomic.LoadInt64(m.stored)
+}
+
+// updateSize applies the changes made in txn to the count of stored bytes
+func (m *MessageDB) updateSize(txn *memdb.Txn) {
+	var delta int64
+	for _, change := range txn.Changes() {
+		switch change.Table {
+		case "message", "revision":
+			if change.Before != nil {
+				delta -= messageSize(change.Before.(*types.Message))
+			}
+			if change.After != nil {
+				delta += messageSize(change.After.(*types.Message))
+			}
+		case "audit":
+			if change.Before != nil {
+				delta -= auditSize(change.Before.(*types.AuditEntry))
+			}
+			if change.After != nil {
+				delta += auditSize(change.After.(*types.AuditEntry))
+			}
+		case "review":
+			if change.Before != nil {
+				delta -= messageSize(change.Before.(*types.Review).Message)
+			}
+			if change.After != nil {
+				delta += messageSize(change.After.(*types.Review).Message)
+			}
+		}
+	}
+	atomic.AddInt64(m.stored, delta)
+}
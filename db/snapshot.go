@@ -0,0 +1,427 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imw-challenge/back/types"
+)
+
+const (
+	snapshotMagic     = "MSGSNAP1"
+	snapshotPrefix    = "snapshot-"
+	snapshotExt       = ".snap"
+	snapshotBatchSize = 1000
+)
+
+// ErrNoSnapshot is returned by LoadSnapshot when no valid snapshot exists
+var ErrNoSnapshot = errors.New("No valid snapshot found")
+
+// snapshotTables are the tables copied into a snapshot, in the order they are encoded
+var snapshotTables = []string{"message", "apikey", "audit", "revision", "review"}
+
+// snapshotHeader precedes the gob encoded rows in a snapshot file
+type snapshotHeader struct {
+	Created       int64 //Unix Epoch Nanoseconds
+	Count         int   //messages
+	KeyCount      int   //API keys, encoded after the messages
+	AuditCount    int   //audit entries, encoded after the API keys
+	RevisionCount int   //message revisions, encoded after the audit entries
+	ReviewCount   int   //reviews of held messages, encoded after the revisions
+	WALPosition   int64 //position in the WAL of the first write not held, zero without a WAL
+}
+
+// WriteSnapshot writes a point-in-time copy of the database to a new
+// file in dir, returning its path. The copy is taken from a read transaction,
+// so writers are not blocked while it is written. The file is laid out as
+// [magic][gob header][gob messages...][gob keys...][gob audit entries...][gob revisions...][gob reviews...][4 byte crc32 of everything before it]
+func (m *MessageDB) WriteSnapshot(dir string) (string, error) {
+	//begin the read holding the writer lock, so that no write commits between
+	//it and reading the WAL position it holds the writes up to
+	lock := m.db.Txn(true)
+	txn := m.db.Txn(false)
+	defer txn.Abort()
+	var position int64
+	if m.wal != nil {
+		var err error
+		if position, err = m.wal.position(); err != nil {
+			lock.Abort()
+			return "", err
+		}
+	}
+	lock.Abort()
+
+	//count first, the read transaction guarantees the second pass sees the same rows
+	counts := make([]int, len(snapshotTables))
+	for i, table := range snapshotTables {
+		it, err := txn.Get(table, "id")
+		if err != nil {
+			return "", err
+		}
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			counts[i]++
+		}
+	}
+
+	now := time.Now().UnixNano()
+	path := filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, now, snapshotExt))
+	tmp, err := ioutil.TempFile(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) //no-op once renamed
+
+	hash := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(tmp, hash))
+	enc := gob.NewEncoder(w)
+
+	if _, err := w.WriteString(snapshotMagic); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := enc.Encode(&snapshotHeader{Created: now, Count: counts[0], KeyCount: counts[1], AuditCount: counts[2], RevisionCount: counts[3], ReviewCount: counts[4], WALPosition: position}); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	for _, table := range snapshotTables {
+		it, err := txn.Get(table, "id")
+		if err != nil {
+			tmp.Close()
+			return "", err
+		}
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			if err := enc.Encode(obj); err != nil {
+				tmp.Close()
+				return "", err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], hash.Sum32())
+	if _, err := tmp.Write(trailer[:]); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+// LoadSnapshot loads the newest valid snapshot in dir into the database,
+// falling back to older snapshots if newer ones fail their checksum.
+// It returns the path of the snapshot loaded, or ErrNoSnapshot. A WAL opened
+// afterwards only replays the writes made after the snapshot was taken
+func (m *MessageDB) LoadSnapshot(dir string) (string, error) {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := verifySnapshot(paths[i]); err != nil {
+			log.Printf("Skipping snapshot %s: %s", paths[i], err)
+			continue
+		}
+		if err := m.readSnapshot(paths[i]); err != nil {
+			return "", err
+		}
+		return paths[i], nil
+	}
+	return "", ErrNoSnapshot
+}
+
+// StartSnapshots writes a snapshot to dir every interval, keeping only the
+// newest retain snapshots, and compacts the WAL down to the writes which the
+// oldest of those does not hold. It returns a function which stops the snapshotter
+func (m *MessageDB) StartSnapshots(dir string, interval time.Duration, retain int) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.WriteSnapshot(dir); err != nil {
+					log.Printf("Error writing snapshot: %s", err)
+					continue
+				}
+				if err := PruneSnapshots(dir, retain); err != nil {
+					log.Printf("Error pruning snapshots: %s", err)
+					continue
+				}
+				if err := m.compactWAL(dir); err != nil {
+					log.Printf("Error compacting WAL: %s", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// PruneSnapshots removes all but the newest retain snapshots in dir
+func PruneSnapshots(dir string, retain int) error {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(paths)-retain; i++ {
+		if err := os.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactWAL drops the WAL records held by every snapshot in dir, so that
+// whichever of them is loaded, the log still holds every write made since
+func (m *MessageDB) compactWAL(dir string) error {
+	if m.wal == nil {
+		return nil
+	}
+	paths, err := listSnapshots(dir)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	oldest := int64(-1)
+	for _, path := range paths {
+		header, err := readSnapshotHeader(path)
+		if err != nil {
+			//a snapshot whose header cannot be read can never be loaded
+			continue
+		}
+		if oldest < 0 || header.WALPosition < oldest {
+			oldest = header.WALPosition
+		}
+	}
+	if oldest <= 0 {
+		return nil
+	}
+
+	//hold the writer lock so nothing is appended while the log is replaced
+	lock := m.db.Txn(true)
+	defer lock.Abort()
+	return m.wal.compact(oldest)
+}
+
+// listSnapshots returns the snapshot files in dir, oldest first
+func listSnapshots(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotExt) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	//names embed a zero-padded timestamp, so lexical order is chronological
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// verifySnapshot checks the magic and trailing checksum of a snapshot file
+func verifySnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size < int64(len(snapshotMagic))+4 {
+		return errors.New("Snapshot truncated")
+	}
+
+	hash := crc32.NewIEEE()
+	if _, err := io.CopyN(hash, f, size-4); err != nil {
+		return err
+	}
+	var trailer [4]byte
+	if _, err := io.ReadFull(f, trailer[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != hash.Sum32() {
+		return errors.New("Snapshot checksum mismatch")
+	}
+	return nil
+}
+
+// openSnapshot opens a snapshot file and reads its header, returning a
+// decoder of the rows which follow it
+func openSnapshot(path string) (*os.File, *gob.Decoder, *snapshotHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	if string(magic) != snapshotMagic {
+		f.Close()
+		return nil, nil, nil, errors.New("Not a snapshot file: " + path)
+	}
+	dec := gob.NewDecoder(r)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	return f, dec, &header, nil
+}
+
+func readSnapshotHeader(path string) (*snapshotHeader, error) {
+	f, _, header, err := openSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return header, nil
+}
+
+// readSnapshot inserts the rows from a verified snapshot file, in
+// batches and without logging them to the WAL
+func (m *MessageDB) readSnapshot(path string) error {
+	f, dec, header, err := openSnapshot(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	batch := make([]*types.Message, 0, snapshotBatchSize)
+	for i := 0; i < header.Count; i++ {
+		message := new(types.Message)
+		if err := dec.Decode(message); err != nil {
+			return err
+		}
+		batch = append(batch, message)
+		if len(batch) == snapshotBatchSize || i == header.Count-1 {
+			if err := m.applyRecord(&walRecord{Op: walOpInsert, Messages: batch}); err != nil {
+				return err
+			}
+			batch = make([]*types.Message, 0, snapshotBatchSize)
+		}
+	}
+
+	keys := make([]*types.APIKey, header.KeyCount)
+	for i := range keys {
+		keys[i] = new(types.APIKey)
+		if err := dec.Decode(keys[i]); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		if err := m.applyRecord(&walRecord{Op: walOpPutKey, Keys: keys}); err != nil {
+			return err
+		}
+	}
+
+	entries := make([]*types.AuditEntry, 0, snapshotBatchSize)
+	for i := 0; i < header.AuditCount; i++ {
+		entry := new(types.AuditEntry)
+		if err := dec.Decode(entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		if len(entries) == snapshotBatchSize || i == header.AuditCount-1 {
+			if err := m.applyRecord(&walRecord{Op: walOpAudit, Audit: entries}); err != nil {
+				return err
+			}
+			entries = make([]*types.AuditEntry, 0, snapshotBatchSize)
+		}
+	}
+
+	//older revisions, the current ones were kept as their messages were applied
+	revisions := make([]*types.Message, 0, snapshotBatchSize)
+	for i := 0; i < header.RevisionCount; i++ {
+		revision := new(types.Message)
+		if err := dec.Decode(revision); err != nil {
+			return err
+		}
+		revisions = append(revisions, revision)
+		if len(revisions) == snapshotBatchSize || i == header.RevisionCount-1 {
+			if err := m.insertRevisions(revisions); err != nil {
+				return err
+			}
+			revisions = make([]*types.Message, 0, snapshotBatchSize)
+		}
+	}
+
+	reviews := make([]*types.Review, 0, snapshotBatchSize)
+	for i := 0; i < header.ReviewCount; i++ {
+		review := new(types.Review)
+		if err := dec.Decode(review); err != nil {
+			return err
+		}
+		reviews = append(reviews, review)
+		if len(reviews) == snapshotBatchSize || i == header.ReviewCount-1 {
+			if err := m.applyRecord(&walRecord{Op: walOpReview, Reviews: reviews}); err != nil {
+				return err
+			}
+			reviews = make([]*types.Review, 0, snapshotBatchSize)
+		}
+	}
+	m.walFrom = header.WALPosition
+	return nil
+}
+
+// insertRevisions inserts a batch of revisions read from a snapshot in one
+// transaction, without logging them to the WAL
+func (m *MessageDB) insertRevisions(revisions []*types.Message) error {
+	txn := m.writeTxn()
+	for _, revision := range revisions {
+		if err := txn.Insert("revision", revision); err != nil {
+			txn.Abort()
+			return err
+		}
+	}
+	m.updateSize(txn)
+	txn.Commit()
+	return nil
+}
+
+// syncDir fsyncs a directory so that a rename within it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
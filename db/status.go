@@ -0,0 +1,78 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/imw-challenge/back/types"
+)
+
+// ErrTransition is returned when a message cannot move from its status to the one asked for
+var ErrTransition = errors.New("Status transition not allowed")
+
+// StatusError is returned by SetStatus, naming the message which could not be
+// moved and its status. Err is ErrNotFound, ErrPreconditionFailed or ErrTransition
+type StatusError struct {
+	ID   string
+	From string //empty if the message was not found
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error() + ": " + e.ID
+}
+
+// SetStatus moves the messages with IDs to status, and returns them as stored,
+// in the order of IDs. The status is bookkeeping rather than content, so as
+// with soft deletion the message keeps its version, and no revision is kept,
+// so rolling back the content never undoes a move. Messages already in that
+// status are returned as they are. If precondition is not nil it is checked
+// against each message first. The messages are moved together in one write
+// transaction, so if any of them is missing, fails the precondition or cannot
+// move to status, nothing is changed and a *StatusError is returned
+func (m *MessageDB) SetStatus(IDs []string, status string, precondition func(*types.Message) bool) ([]*types.Message, error) {
+	txn := m.writeTxn()
+
+	messages := make([]*types.Message, 0, len(IDs))
+	var changed []*types.Message
+	for _, ID := range IDs {
+		current, err := liveMessage(txn, ID)
+		if err == ErrNotFound {
+			txn.Abort()
+			return nil, &StatusError{ID: ID, Err: err}
+		}
+		if err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		if precondition != nil && !precondition(current) {
+			txn.Abort()
+			return nil, &StatusError{ID: ID, From: current.Status, Err: ErrPreconditionFailed}
+		}
+		if !types.CanTransition(current.Status, status) {
+			txn.Abort()
+			return nil, &StatusError{ID: ID, From: current.Status, Err: ErrTransition}
+		}
+		if current.Status == status {
+			messages = append(messages, current)
+			continue
+		}
+
+		moved := *current
+		moved.Status = status
+		if err := txn.Insert("message", &moved); err != nil {
+			txn.Abort()
+			return nil, err
+		}
+		messages = append(messages, &moved)
+		changed = append(changed, &moved)
+	}
+
+	if changed == nil {
+		txn.Abort()
+		return messages, nil
+	}
+	if err := m.commit(txn, &walRecord{Op: walOpInsert, Messages: changed}); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/imw-challenge/back/types"
+)
+
+const walHeaderSize = 8
+
+const (
+	walMagic          = "MSGWAL01"
+	walFileHeaderSize = 16
+)
+
+// maxWALRecordSize bounds the payload of a record, well above the largest
+// batch we write, so that a corrupt length is not trusted with an allocation
+const maxWALRecordSize = 64 << 20
+
+const (
+	walOpInsert = "insert" //upsert of Messages
+	walOpDelete = "delete" //removal of IDs
+	walOpPutKey = "putkey" //upsert of Keys
+	walOpAudit  = "audit"  //Audit entries alone, which any record may also carry
+	walOpReview = "review" //upsert of Reviews alone, which an insert may also carry
+)
+
+// walRecord is a single entry in the write-ahead log
+type walRecord struct {
+	Op       string
+	Messages []*types.Message
+	IDs      []string
+	Keys     []*types.APIKey
+	Reviews  []*types.Review
+	Audit    []*types.AuditEntry
+}
+
+// wal is an append-only write-ahead log of MessageDB mutations
+// each record is framed as [4 byte length][4 byte crc32][gob payload],
+// so a write torn by a crash can be detected and discarded on replay
+// records are addressed by their position in the log as a whole, which stays
+// the same when the log is compacted. The file starts with
+// [magic][8 byte position of its first record], unless it was written before
+// logs were compacted, in which case its first record is at position 0
+type wal struct {
+	f     *os.File
+	path  string
+	base  int64 //position of the first record in the file
+	start int64 //file offset of the first record
+	err   error //set if a failed append could not be rolled back, refusing later appends
+}
+
+// ErrWALGap is returned when the oldest record in the log is newer than the
+// data it is replayed over, so writes in between would be lost
+var ErrWALGap = errors.New("WAL was compacted past the data loaded, a newer snapshot is needed")
+
+// openWAL opens (or creates) the log at path, calls apply for every intact
+// record at or past position from, truncates any torn tail and leaves the
+// file ready for appends
+func openWAL(path string, from int64, apply func(*walRecord) error) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{f: f, path: path}
+	if err := w.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if w.base > from {
+		f.Close()
+		return nil, ErrWALGap
+	}
+
+	if _, err := f.Seek(w.start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	skip := from - w.base
+	good, err := replayWAL(f, func(offset int64, rec *walRecord) error {
+		if offset < skip {
+			return nil
+		}
+		return apply(rec)
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	//discard anything after the last intact record
+	if err := f.Truncate(w.start + good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if w.start == 0 && good == 0 {
+		//an empty log, which can be given a header
+		if err := w.writeHeader(f, 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		w.start = walFileHeaderSize
+	}
+	if _, err := f.Seek(w.start+good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// readHeader reads the position of the first record from the file header,
+// if the file has one
+func (w *wal) readHeader() error {
+	header := make([]byte, walFileHeaderSize)
+	n, err := io.ReadFull(w.f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n == walFileHeaderSize && string(header[:len(walMagic)]) == walMagic {
+		w.base = int64(binary.BigEndian.Uint64(header[len(walMagic):]))
+		w.start = walFileHeaderSize
+	}
+	return nil
+}
+
+func (w *wal) writeHeader(f *os.File, base int64) error {
+	header := make([]byte, walFileHeaderSize)
+	copy(header, walMagic)
+	binary.BigEndian.PutUint64(header[len(walMagic):], uint64(base))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// position returns the position just past the last record
+func (w *wal) position() (int64, error) {
+	end, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	return w.base + end - w.start, nil
+}
+
+// compact drops the records before position to, by copying the rest to a new
+// file which replaces the log. Appends must not run while it does
+func (w *wal) compact(to int64) error {
+	if w.err != nil {
+		return w.err
+	}
+	end, err := w.position()
+	if err != nil {
+		return err
+	}
+	if to <= w.base || to > end {
+		return nil
+	}
+
+	dir := filepath.Dir(w.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(w.path)+"*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //no-op once renamed
+	if err := w.writeHeader(tmp, to); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Seek(walFileHeaderSize, io.SeekStart); err != nil {
+		tmp.Close()
+		return err
+	}
+	tail := io.NewSectionReader(w.f, w.start+to-w.base, end-to)
+	if _, err := io.Copy(tmp, tail); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	//appends go to the new file from here on. If the rename is not yet
+	//durable, either file is safe to replay, as both hold every record past to
+	w.f.Close()
+	w.f, w.base, w.start = tmp, to, walFileHeaderSize
+	if _, err := w.f.Seek(0, io.SeekEnd); err != nil {
+		w.err = err
+		return err
+	}
+	return syncDir(dir)
+}
+
+// replayWAL reads records from r until EOF or the first damaged record,
+// returning the offset just past the last intact record. Each record is
+// passed to apply with its offset. A torn tail can only be short, or fail its
+// checksum; a record which passes its checksum but cannot be decoded is
+// corruption, and is returned as an error
+func replayWAL(r io.Reader, apply func(int64, *walRecord) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if length > maxWALRecordSize {
+			return offset, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return offset, nil
+		}
+
+		var rec walRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return offset, fmt.Errorf("undecodable WAL record at offset %d: %s", offset, err)
+		}
+		if err := apply(offset, &rec); err != nil {
+			return offset, err
+		}
+		offset += walHeaderSize + int64(length)
+	}
+}
+
+// append writes a record to the end of the log and fsyncs it. If the write
+// or the sync fails, the frame is truncated away so that it is not replayed
+// after a restart. If even that fails, the log is left refusing every append
+func (w *wal) append(rec *walRecord) error {
+	if w.err != nil {
+		return w.err
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(rec); err != nil {
+		return err
+	}
+	if payload.Len() > maxWALRecordSize {
+		return errors.New("WAL record too large")
+	}
+
+	frame := make([]byte, walHeaderSize, walHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+
+	start, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Write(frame)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		//roll back the frame, which may be partly or wholly on disk, so that
+		//an aborted write is never replayed, nor later appends hidden behind it
+		if rollbackErr := w.rollback(start); rollbackErr != nil {
+			w.err = errors.New("WAL could not be rolled back after a failed append: " + rollbackErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func (w *wal) rollback(start int64) error {
+	if err := w.f.Truncate(start); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *wal) close() error {
+	return w.f.Close()
+}
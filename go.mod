@@ -1,8 +1,9 @@
 module github.com/imw-challenge/back
 
-go 1.12
+go 1.13
 
 require (
 	github.com/gorilla/mux v1.7.3
-	github.com/hashicorp/go-memdb v1.0.4
+	github.com/hashicorp/go-memdb v1.3.5
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 )
@@ -0,0 +1,103 @@
+package moderation
+
+import (
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/imw-challenge/back/types"
+)
+
+// DefaultMinExamples is how many spam and how many other messages a Bayes
+// filter must be trained on before it scores messages, unless set otherwise
+const DefaultMinExamples = 10
+
+// Bayes is a naive Bayes classifier over the words of messages, trained on
+// messages labelled as spam or not. Messages whose spam probability reaches
+// Quarantine are quarantined, and those reaching Reject are rejected. A zero
+// threshold is not applied
+type Bayes struct {
+	Quarantine  float64
+	Reject      float64
+	MinExamples int
+
+	mu         sync.RWMutex
+	counts     [2]map[string]int //word counts, of other messages and then of spam
+	words      [2]int            //total words
+	messages   [2]int
+	vocabulary int //distinct words seen in either class
+}
+
+func InitBayes(quarantine, reject float64) *Bayes {
+	return &Bayes{
+		Quarantine:  quarantine,
+		Reject:      reject,
+		MinExamples: DefaultMinExamples,
+		counts:      [2]map[string]int{make(map[string]int), make(map[string]int)},
+	}
+}
+
+func class(spam bool) int {
+	if spam {
+		return 1
+	}
+	return 0
+}
+
+// Train counts the words of a message labelled as spam or not
+func (b *Bayes) Train(message *types.Message, spam bool) {
+	c := class(spam)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, term := range messageTerms(message) {
+		if b.counts[0][term] == 0 && b.counts[1][term] == 0 {
+			b.vocabulary++
+		}
+		b.counts[c][term]++
+		b.words[c]++
+	}
+	b.messages[c]++
+}
+
+// Score returns the probability that a message is spam, and false if the
+// filter has not yet been trained on enough messages to tell
+func (b *Bayes) Score(message *types.Message) (float64, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.messages[0] < b.MinExamples || b.messages[1] < b.MinExamples {
+		return 0, false
+	}
+
+	//log probabilities of each class, with add-one smoothing over the
+	//vocabulary seen in training. words seen in neither class are skipped,
+	//as smoothing alone would still weigh them toward the class with fewer
+	//words
+	vocabulary := b.vocabulary
+	total := float64(b.messages[0] + b.messages[1])
+	var logs [2]float64
+	for c := range logs {
+		logs[c] = math.Log(float64(b.messages[c]) / total)
+		for _, term := range messageTerms(message) {
+			if b.counts[0][term]+b.counts[1][term] == 0 {
+				continue
+			}
+			logs[c] += math.Log(float64(b.counts[c][term]+1) / float64(b.words[c]+vocabulary))
+		}
+	}
+	return 1 / (1 + math.Exp(logs[0]-logs[1])), true
+}
+
+func (b *Bayes) Check(message *types.Message) Verdict {
+	score, ok := b.Score(message)
+	if !ok {
+		return Verdict{}
+	}
+	reasons := []string{"spam score " + strconv.FormatFloat(score, 'f', 2, 64)}
+	switch {
+	case b.Reject > 0 && score >= b.Reject:
+		return Verdict{Action: Reject, Reasons: reasons}
+	case b.Quarantine > 0 && score >= b.Quarantine:
+		return Verdict{Action: Quarantine, Reasons: reasons}
+	}
+	return Verdict{}
+}
@@ -0,0 +1,273 @@
+package moderation
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imw-challenge/back/search"
+	"github.com/imw-challenge/back/types"
+)
+
+// Action is what becomes of a message, ordered from the most lenient to the least
+type Action int
+
+const (
+	Accept     Action = iota //stored as it is
+	Quarantine               //held until an admin approves or rejects it
+	Reject                   //refused, and not stored
+)
+
+func (a Action) String() string {
+	switch a {
+	case Accept:
+		return "accept"
+	case Quarantine:
+		return "quarantine"
+	case Reject:
+		return "reject"
+	}
+	return "action " + strconv.Itoa(int(a))
+}
+
+// Verdict is the action a filter takes on a message, and why
+type Verdict struct {
+	Action  Action
+	Reasons []string
+}
+
+// Filter decides what becomes of a new public message
+type Filter interface {
+	Check(message *types.Message) Verdict
+}
+
+// Trainer is a filter which learns from the messages admins have labelled
+type Trainer interface {
+	Train(message *types.Message, spam bool)
+}
+
+// Pipeline runs every one of its filters over a message, taking the least
+// lenient of their actions. It is safe for concurrent use once built
+type Pipeline struct {
+	filters []Filter
+}
+
+func InitPipeline(filters ...Filter) *Pipeline {
+	return &Pipeline{filters: filters}
+}
+
+// Check runs every filter, so that each sees every message, and returns the
+// least lenient action along with the reasons of every filter which took it
+// or another action short of accepting
+func (p *Pipeline) Check(message *types.Message) Verdict {
+	var verdict Verdict
+	for _, filter := range p.filters {
+		v := filter.Check(message)
+		if v.Action == Accept {
+			continue
+		}
+		if v.Action > verdict.Action {
+			verdict.Action = v.Action
+		}
+		verdict.Reasons = append(verdict.Reasons, v.Reasons...)
+	}
+	return verdict
+}
+
+// Train passes a labelled message to every filter which learns
+func (p *Pipeline) Train(message *types.Message, spam bool) {
+	for _, filter := range p.filters {
+		if trainer, ok := filter.(Trainer); ok {
+			trainer.Train(message, spam)
+		}
+	}
+}
+
+// messageTerms returns the words of every field of a message
+func messageTerms(message *types.Message) []string {
+	return search.Terms(message.Name + "\n" + message.Email + "\n" + message.Text)
+}
+
+// Blocklist takes its action on messages holding any of its phrases, matched
+// as whole words in any case, or matching any of its patterns
+type Blocklist struct {
+	phrases  [][]string
+	patterns []*regexp.Regexp
+	action   Action
+}
+
+// InitBlocklist builds a blocklist from entries, each a word or phrase, or a
+// regular expression between slashes
+func InitBlocklist(entries []string, action Action) (*Blocklist, error) {
+	b := &Blocklist{action: action}
+	for _, entry := range entries {
+		if len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			pattern, err := regexp.Compile(entry[1 : len(entry)-1])
+			if err != nil {
+				return nil, errors.New("Invalid blocklist pattern " + entry + ": " + err.Error())
+			}
+			b.patterns = append(b.patterns, pattern)
+			continue
+		}
+		if phrase := search.Terms(entry); len(phrase) > 0 {
+			b.phrases = append(b.phrases, phrase)
+		}
+	}
+	return b, nil
+}
+
+// LoadBlocklist reads a blocklist from a file of entries as for
+// InitBlocklist, one per line. Blank lines and lines starting with # are skipped
+func LoadBlocklist(path string, action Action) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return InitBlocklist(entries, action)
+}
+
+func (b *Blocklist) Check(message *types.Message) Verdict {
+	var reasons []string
+	terms := messageTerms(message)
+	for _, phrase := range b.phrases {
+		if containsPhrase(terms, phrase) {
+			reasons = append(reasons, "blocked phrase "+strconv.Quote(strings.Join(phrase, " ")))
+		}
+	}
+	for _, pattern := range b.patterns {
+		if pattern.MatchString(message.Name) || pattern.MatchString(message.Email) || pattern.MatchString(message.Text) {
+			reasons = append(reasons, "blocked pattern /"+pattern.String()+"/")
+		}
+	}
+	if reasons == nil {
+		return Verdict{}
+	}
+	return Verdict{Action: b.action, Reasons: reasons}
+}
+
+func containsPhrase(terms, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(terms); i++ {
+		match := true
+		for j, term := range phrase {
+			if terms[i+j] != term {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkLimit quarantines messages with more than Quarantine links, and rejects
+// those with more than Reject. A zero limit is not applied
+type LinkLimit struct {
+	Quarantine int
+	Reject     int
+}
+
+func (l *LinkLimit) Check(message *types.Message) Verdict {
+	links := len(linkPattern.FindAllStringIndex(message.Name, -1)) + len(linkPattern.FindAllStringIndex(message.Text, -1))
+	reasons := []string{strconv.Itoa(links) + " links"}
+	switch {
+	case l.Reject > 0 && links > l.Reject:
+		return Verdict{Action: Reject, Reasons: reasons}
+	case l.Quarantine > 0 && links > l.Quarantine:
+		return Verdict{Action: Quarantine, Reasons: reasons}
+	}
+	return Verdict{}
+}
+
+const (
+	//the most distinct texts remembered at once by Repeats, past which new
+	//texts are not counted until older ones leave the window
+	maxRepeatTexts = 100000
+)
+
+// Repeats takes its action on a message whose text has already been sent
+// max times within the window before it, compared by its words in any case
+type Repeats struct {
+	window time.Duration
+	max    int
+	action Action
+
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte][]time.Time
+	swept time.Time
+}
+
+// InitRepeats builds a Repeats filter, whose max should be at least one
+func InitRepeats(window time.Duration, max int, action Action) *Repeats {
+	return &Repeats{window: window, max: max, action: action, seen: make(map[[sha256.Size]byte][]time.Time)}
+}
+
+func (r *Repeats) Check(message *types.Message) Verdict {
+	return r.check(message, time.Now())
+}
+
+// check counts the message's text as sent at now, and returns the action
+// if it had already been sent max times in the window before
+func (r *Repeats) check(message *types.Message, now time.Time) Verdict {
+	key := sha256.Sum256([]byte(strings.Join(search.Terms(message.Text), " ")))
+	cutoff := now.Add(-r.window)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.swept) >= r.window {
+		r.sweep(cutoff)
+		r.swept = now
+	}
+	times := recent(r.seen[key], cutoff)
+	sent := len(times)
+	if sent > 0 || len(r.seen) < maxRepeatTexts {
+		r.seen[key] = append(times, now)
+	}
+	if sent < r.max {
+		return Verdict{}
+	}
+	return Verdict{Action: r.action, Reasons: []string{"sent " + strconv.Itoa(sent+1) + " times in " + r.window.String()}}
+}
+
+// sweep forgets the texts not sent since cutoff. Call with mu held
+func (r *Repeats) sweep(cutoff time.Time) {
+	for key, times := range r.seen {
+		if times = recent(times, cutoff); len(times) == 0 {
+			delete(r.seen, key)
+		} else {
+			r.seen[key] = times
+		}
+	}
+}
+
+// recent drops the times before cutoff from a list in the order they happened
+func recent(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
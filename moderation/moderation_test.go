@@ -0,0 +1,170 @@
+package moderation
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/imw-challenge/back/types"
+)
+
+func text(s string) *types.Message {
+	return &types.Message{Name: "Isaac Wilder", Email: "name@fake.domain", Text: s}
+}
+
+func TestBlocklist(t *testing.T) {
+	b, err := InitBlocklist([]string{"casino", "Cheap Pills", `/\d{4}-\d{4}-\d{4}-\d{4}/`}, Quarantine)
+	if err != nil {
+		t.Fatalf("Error building blocklist: %s", err)
+	}
+	cases := []struct {
+		text    string
+		action  Action
+		reasons int
+	}{
+		{"hi there", Accept, 0},
+		{"Visit our CASINO!", Quarantine, 1},
+		{"casinos are words of their own", Accept, 0},
+		{"cheap, pills", Quarantine, 1},
+		{"pills that are cheap", Accept, 0},
+		{"card 1234-5678-9012-3456 at the casino", Quarantine, 2},
+	}
+	for _, c := range cases {
+		v := b.Check(text(c.text))
+		if v.Action != c.action || len(v.Reasons) != c.reasons {
+			t.Errorf("%q: expected %s with %d reasons. Got %s %v", c.text, c.action, c.reasons, v.Action, v.Reasons)
+		}
+	}
+
+	if _, err := InitBlocklist([]string{"/(/"}, Reject); err == nil {
+		t.Error("Expected an invalid pattern to be refused")
+	}
+}
+
+func TestLoadBlocklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocklist")
+	ioutil.WriteFile(path, []byte("# spam words\n\ncasino\n/^buy now/\n"), 0644)
+
+	b, err := LoadBlocklist(path, Reject)
+	if err != nil {
+		t.Fatalf("Error loading blocklist: %s", err)
+	}
+	if v := b.Check(text("buy now at the casino")); v.Action != Reject || len(v.Reasons) != 2 {
+		t.Errorf("Expected both entries to match. Got %s %v", v.Action, v.Reasons)
+	}
+	if v := b.Check(text("spam words")); v.Action != Accept {
+		t.Errorf("Expected comments to be skipped. Got %s %v", v.Action, v.Reasons)
+	}
+}
+
+func TestLinkLimit(t *testing.T) {
+	l := &LinkLimit{Quarantine: 1, Reject: 3}
+	for links, action := range []Action{Accept, Accept, Quarantine, Quarantine, Reject} {
+		s := ""
+		for i := 0; i < links; i++ {
+			s += " see https://example.com/" + strconv.Itoa(i)
+		}
+		if v := l.Check(text(s)); v.Action != action {
+			t.Errorf("%d links: expected %s. Got %s", links, action, v.Action)
+		}
+	}
+	if v := l.Check(&types.Message{Name: "www.spam.example", Text: "and www.more.example"}); v.Action != Quarantine {
+		t.Errorf("Expected links in the name to count. Got %s", v.Action)
+	}
+}
+
+func TestRepeats(t *testing.T) {
+	r := InitRepeats(time.Hour, 2, Quarantine)
+	now := time.Unix(1500000000, 0)
+	expect := func(s string, at time.Duration, action Action) {
+		t.Helper()
+		if v := r.check(text(s), now.Add(at)); v.Action != action {
+			t.Errorf("%q at %s: expected %s. Got %s %v", s, at, action, v.Action, v.Reasons)
+		}
+	}
+	expect("hello there", 0, Accept)
+	expect("Hello,  there!", time.Minute, Accept)
+	expect("hello there", 2*time.Minute, Quarantine)
+	expect("something else", 3*time.Minute, Accept)
+	//the first send leaves the window, but two are still in it
+	expect("hello there", time.Hour+30*time.Second, Quarantine)
+	expect("hello there", 3*time.Hour, Accept)
+	if len(r.seen) != 1 {
+		t.Errorf("Expected texts outside the window to be swept. Got %d", len(r.seen))
+	}
+}
+
+func TestBayes(t *testing.T) {
+	b := InitBayes(0.8, 0.99)
+	b.MinExamples = 3
+	spam := []string{"cheap pills online now", "win a free prize now", "cheap prize pills", "free casino money now"}
+	ham := []string{"hi there, how are you", "thanks for the lovely evening", "are you free for lunch on friday", "see you at the meeting"}
+
+	if _, ok := b.Score(text("cheap pills")); ok {
+		t.Error("Expected no score before training")
+	}
+	for i := range spam {
+		b.Train(text(spam[i]), true)
+		b.Train(text(ham[i]), false)
+	}
+	if score, ok := b.Score(text("cheap free pills now now")); !ok || score < 0.99 {
+		t.Errorf("Expected spam to score highly. Got %f, %t", score, ok)
+	}
+	if score, _ := b.Score(text("how are you, see you friday")); score > 0.2 {
+		t.Errorf("Expected other messages to score low. Got %f", score)
+	}
+	if v := b.Check(text("cheap free pills now now")); v.Action != Reject || len(v.Reasons) != 1 {
+		t.Errorf("Expected spam to be rejected. Got %s %v", v.Action, v.Reasons)
+	}
+	if v := b.Check(text("hi there, see you at lunch")); v.Action != Accept {
+		t.Errorf("Expected other messages to be accepted. Got %s %v", v.Action, v.Reasons)
+	}
+
+	//the vocabulary counts each word once, whichever classes it was seen in
+	distinct := map[string]bool{}
+	for c := range b.counts {
+		for term := range b.counts[c] {
+			distinct[term] = true
+		}
+	}
+	if b.vocabulary != len(distinct) {
+		t.Errorf("Expected a vocabulary of %d words. Got %d", len(distinct), b.vocabulary)
+	}
+
+	//words never seen in training leave only the prior
+	b.Train(text("cheap casino prize"), true)
+	if score, _ := b.Score(&types.Message{Name: "Ada", Email: "ada@elsewhere", Text: "quarterly budget spreadsheet attached"}); math.Abs(score-5.0/9) > 1e-9 {
+		t.Errorf("Expected unseen words to score the prior of %f. Got %f", 5.0/9, score)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	blocklist, _ := InitBlocklist([]string{"casino"}, Quarantine)
+	bayes := InitBayes(0.5, 0)
+	bayes.MinExamples = 1
+	p := InitPipeline(blocklist, &LinkLimit{Reject: 1}, bayes)
+
+	if v := p.Check(text("hi there")); v.Action != Accept || v.Reasons != nil {
+		t.Errorf("Expected the message to be accepted. Got %s %v", v.Action, v.Reasons)
+	}
+	v := p.Check(text("casino at https://a.example and https://b.example"))
+	if v.Action != Reject || len(v.Reasons) != 2 {
+		t.Errorf("Expected the least lenient action, with every reason. Got %s %v", v.Action, v.Reasons)
+	}
+
+	//training reaches the filters which learn
+	p.Train(text("lottery winnings"), true)
+	p.Train(text("hi there"), false)
+	if v := p.Check(text("lottery lottery")); v.Action != Quarantine {
+		t.Errorf("Expected the trained filter to quarantine. Got %s %v", v.Action, v.Reasons)
+	}
+}
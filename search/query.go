@@ -0,0 +1,161 @@
+package search
+
+import (
+	"errors"
+	"html"
+	"strings"
+)
+
+// snippetContext is the number of words kept before the first match in a snippet
+const snippetContext = 5
+
+// Clause is a single term, or a phrase whose terms must appear in order
+type Clause struct {
+	Terms []string
+}
+
+// Query matches documents satisfying every clause of at least one group
+type Query struct {
+	Groups [][]Clause
+}
+
+// ParseQuery parses a query string, in which whitespace separated words must
+// all match, OR separates alternatives, and double quotes group a phrase.
+// A word which tokenizes to several terms, such as an email address,
+// is matched as a phrase
+//
+//	hello world            both hello and world
+//	hello OR goodbye       either hello or goodbye
+//	"hi there" isaac       the phrase hi there, and isaac
+func ParseQuery(raw string) (*Query, error) {
+	q := &Query{}
+	var group []Clause
+
+	words, err := splitQuery(raw)
+	if err != nil {
+		return nil, err
+	}
+	for _, word := range words {
+		if word == "OR" {
+			if len(group) == 0 {
+				return nil, errors.New("OR must come between terms")
+			}
+			q.Groups = append(q.Groups, group)
+			group = nil
+			continue
+		}
+		if word == "AND" {
+			continue
+		}
+		var terms []string
+		for _, tok := range tokenize(word) {
+			terms = append(terms, tok.term)
+		}
+		if len(terms) > 0 {
+			group = append(group, Clause{terms})
+		}
+	}
+	if len(group) == 0 {
+		if len(q.Groups) > 0 {
+			return nil, errors.New("OR must come between terms")
+		}
+		return nil, errors.New("Query has no terms")
+	}
+	q.Groups = append(q.Groups, group)
+	return q, nil
+}
+
+// splitQuery splits on whitespace, keeping quoted phrases together
+func splitQuery(raw string) ([]string, error) {
+	var words []string
+	for {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			return words, nil
+		}
+		if raw[0] == '"' {
+			end := strings.IndexByte(raw[1:], '"')
+			if end < 0 {
+				return nil, errors.New("Unterminated phrase")
+			}
+			words = append(words, raw[1:end+1])
+			raw = raw[end+2:]
+			continue
+		}
+		end := strings.IndexAny(raw, " \t\n\"")
+		if end < 0 {
+			end = len(raw)
+		}
+		words = append(words, raw[:end])
+		raw = raw[end:]
+	}
+}
+
+// Terms returns every distinct term in the query
+func (q *Query) Terms() []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, group := range q.Groups {
+		for _, clause := range group {
+			for _, term := range clause.Terms {
+				if !seen[term] {
+					seen[term] = true
+					terms = append(terms, term)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// Snippet returns up to maxWords words of text around the first query term
+// found in it, HTML escaped, with each query term wrapped in <em> tags.
+// It returns false if no query term appears in the text
+func (q *Query) Snippet(text string, maxWords int) (string, bool) {
+	terms := make(map[string]bool)
+	for _, term := range q.Terms() {
+		terms[term] = true
+	}
+	tokens := tokenize(text)
+
+	first := -1
+	for i, tok := range tokens {
+		if terms[tok.term] {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	from := first - snippetContext
+	if from < 0 {
+		from = 0
+	}
+	to := from + maxWords
+	if to > len(tokens) {
+		to = len(tokens)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	offset := tokens[from].start
+	for _, tok := range tokens[from:to] {
+		b.WriteString(html.EscapeString(text[offset:tok.start]))
+		if terms[tok.term] {
+			b.WriteString("<em>" + html.EscapeString(text[tok.start:tok.end]) + "</em>")
+		} else {
+			b.WriteString(html.EscapeString(text[tok.start:tok.end]))
+		}
+		offset = tok.end
+	}
+	if to < len(tokens) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(html.EscapeString(text[offset:]))
+	}
+	return b.String(), true
+}
@@ -0,0 +1,242 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters, using the usual defaults
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Index is an in-memory inverted index of documents made up of one or more
+// text fields. Token positions are recorded so that phrases can be matched,
+// with a gap between fields so that a phrase never spans two of them.
+// It is safe for concurrent use
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string]map[string][]int //term -> document ID -> positions
+	docs     map[string]*document
+	totalLen int
+}
+
+type document struct {
+	length int
+	terms  []string //distinct terms, so the document can be removed
+}
+
+// Hit is a document matching a query, with its BM25 relevance score
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// token is a lowercased word, and the byte offsets it came from
+type token struct {
+	term       string
+	start, end int
+}
+
+func InitIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[string][]int),
+		docs:     make(map[string]*document),
+	}
+}
+
+// Add indexes a document, replacing any earlier version with the same ID
+func (idx *Index) Add(ID string, fields ...string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(ID)
+
+	positions := make(map[string][]int)
+	pos := 0
+	for _, field := range fields {
+		for _, tok := range tokenize(field) {
+			positions[tok.term] = append(positions[tok.term], pos)
+			pos++
+		}
+		pos++ //gap between fields
+	}
+
+	doc := &document{length: pos - len(fields)}
+	for term, termPositions := range positions {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = make(map[string][]int)
+			idx.postings[term] = docs
+		}
+		docs[ID] = termPositions
+		doc.terms = append(doc.terms, term)
+	}
+	idx.docs[ID] = doc
+	idx.totalLen += doc.length
+}
+
+// Remove drops a document from the index, if it is present
+func (idx *Index) Remove(ID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(ID)
+}
+
+func (idx *Index) remove(ID string) {
+	doc, ok := idx.docs[ID]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(idx.postings[term], ID)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLen -= doc.length
+	delete(idx.docs, ID)
+}
+
+// Len returns the number of documents in the index
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// Search returns the documents matching q, most relevant first
+func (idx *Index) Search(q *Query) []Hit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	matched := make(map[string]bool)
+	for _, group := range q.Groups {
+		for ID := range idx.matchGroup(group) {
+			matched[ID] = true
+		}
+	}
+
+	terms := q.Terms()
+	hits := make([]Hit, 0, len(matched))
+	for ID := range matched {
+		hits = append(hits, Hit{ID: ID, Score: idx.score(ID, terms)})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	return hits
+}
+
+// matchGroup returns the documents matching every clause of an AND group
+func (idx *Index) matchGroup(group []Clause) map[string]bool {
+	//start from the rarest first term, to keep the candidate set small
+	var candidates map[string][]int
+	for i, clause := range group {
+		docs := idx.postings[clause.Terms[0]]
+		if i == 0 || len(docs) < len(candidates) {
+			candidates = docs
+		}
+	}
+
+	matched := make(map[string]bool)
+	for ID := range candidates {
+		all := true
+		for _, clause := range group {
+			if !idx.matchClause(ID, clause) {
+				all = false
+				break
+			}
+		}
+		if all {
+			matched[ID] = true
+		}
+	}
+	return matched
+}
+
+// matchClause reports whether a document holds a term, or a phrase in order
+func (idx *Index) matchClause(ID string, clause Clause) bool {
+	first, ok := idx.postings[clause.Terms[0]][ID]
+	if !ok {
+		return false
+	}
+	for _, start := range first {
+		found := true
+		for i, term := range clause.Terms[1:] {
+			if !containsInt(idx.postings[term][ID], start+i+1) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// score computes the BM25 score of a document for a set of query terms
+func (idx *Index) score(ID string, terms []string) float64 {
+	n := float64(len(idx.docs))
+	avgLen := float64(idx.totalLen) / n
+	if avgLen == 0 {
+		avgLen = 1
+	}
+	docLen := float64(idx.docs[ID].length)
+
+	var score float64
+	for _, term := range terms {
+		docs := idx.postings[term]
+		freq := float64(len(docs[ID]))
+		if freq == 0 {
+			continue
+		}
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * freq * (bm25K1 + 1) / (freq + bm25K1*(1-bm25B+bm25B*docLen/avgLen))
+	}
+	return score
+}
+
+// Terms returns the lowercased words of text, as they are indexed
+func Terms(text string) []string {
+	tokens := tokenize(text)
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.term
+	}
+	return terms
+}
+
+// tokenize splits text into lowercased runs of letters and digits
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		}
+		if !isWord && start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+func containsInt(sorted []int, x int) bool {
+	i := sort.SearchInts(sorted, x)
+	return i < len(sorted) && sorted[i] == x
+}
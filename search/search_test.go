@@ -0,0 +1,138 @@
+package search
+
+import (
+	"testing"
+)
+
+func initTestIndex() *Index {
+	idx := InitIndex()
+	idx.Add("a", "Isaac Wilder", "name@fake.domain", "hi there")
+	idx.Add("b", "Reggie Tester", "false@email.address", "lorem ipsum dolor sit amet")
+	idx.Add("c", "Alex Mustermann", "fake@site.biz", "testing, testing, hello there")
+	idx.Add("d", "Isaac Wilder", "name@fake.domain", "there, hi again")
+	return idx
+}
+
+func searchIDs(t *testing.T, idx *Index, raw string) []string {
+	q, err := ParseQuery(raw)
+	if err != nil {
+		t.Fatalf("Error parsing query %q: %s", raw, err)
+	}
+	var IDs []string
+	for _, hit := range idx.Search(q) {
+		IDs = append(IDs, hit.ID)
+	}
+	return IDs
+}
+
+func sameIDs(a, b []string) bool {
+	seen := map[string]int{}
+	for _, ID := range a {
+		seen[ID]++
+	}
+	for _, ID := range b {
+		seen[ID]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestSearchQueries(t *testing.T) {
+	idx := initTestIndex()
+	cases := map[string][]string{
+		"there":               {"a", "c", "d"},
+		"THERE isaac":         {"a", "d"},
+		"hi AND there":        {"a", "d"},
+		`"hi there"`:          {"a"},
+		`"there hi"`:          {"d"},
+		"lorem OR mustermann": {"b", "c"},
+		`"hi there" OR ipsum`: {"a", "b"},
+		"fake":                {"a", "c", "d"},
+		"name@fake.domain":    {"a", "d"},
+		"missing":             nil,
+		"missing there":       nil,
+		//phrases never span fields
+		`"wilder name"`: nil,
+	}
+	for raw, expected := range cases {
+		if IDs := searchIDs(t, idx, raw); !sameIDs(IDs, expected) {
+			t.Errorf("Query %q expected %v. Got %v", raw, expected, IDs)
+		}
+	}
+
+	for _, raw := range []string{"", "   ", "OR there", "there OR", `"unterminated`} {
+		if _, err := ParseQuery(raw); err == nil {
+			t.Errorf("Expected error parsing %q", raw)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := initTestIndex()
+	//c mentions testing twice, so ranks above a message mentioning it once
+	idx.Add("e", "Tess Ting", "tess@ting.org", "testing the ranking with many other words in here")
+	if IDs := searchIDs(t, idx, "testing"); len(IDs) != 2 || IDs[0] != "c" {
+		t.Errorf("Expected c to rank first. Got %v", IDs)
+	}
+
+	//rarer terms count for more
+	q, _ := ParseQuery("there OR lorem")
+	hits := idx.Search(q)
+	if hits[0].ID != "b" {
+		t.Errorf("Expected the rare term to rank first. Got %v", hits)
+	}
+}
+
+func TestIndexUpdate(t *testing.T) {
+	idx := initTestIndex()
+
+	idx.Add("a", "Isaac Wilder", "name@fake.domain", "goodbye")
+	if IDs := searchIDs(t, idx, `"hi there"`); len(IDs) != 0 {
+		t.Errorf("Expected replaced text to be gone from the index. Got %v", IDs)
+	}
+	if IDs := searchIDs(t, idx, "goodbye"); !sameIDs(IDs, []string{"a"}) {
+		t.Errorf("Expected replaced text to be indexed. Got %v", IDs)
+	}
+
+	idx.Remove("a")
+	idx.Remove("no-such-document")
+	if IDs := searchIDs(t, idx, "isaac"); !sameIDs(IDs, []string{"d"}) {
+		t.Errorf("Expected removed document to be gone. Got %v", IDs)
+	}
+	if idx.Len() != 3 {
+		t.Errorf("Expected 3 documents. Got %d", idx.Len())
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	q, _ := ParseQuery("fox OR dog")
+	text := "The quick brown fox jumps over the lazy <dog>, and keeps running for a very long way afterwards."
+
+	snippet, ok := q.Snippet(text, 6)
+	if !ok {
+		t.Fatal("Expected a snippet")
+	}
+	expected := "The quick brown <em>fox</em> jumps over…"
+	if snippet != expected {
+		t.Errorf("Expected snippet %q. Got %q", expected, snippet)
+	}
+
+	snippet, _ = q.Snippet("a b c d e f g dog!", 10)
+	expected = "…c d e f g <em>dog</em>!"
+	if snippet != expected {
+		t.Errorf("Expected snippet %q. Got %q", expected, snippet)
+	}
+
+	snippet, _ = q.Snippet("my <dog>", 10)
+	if snippet != "my &lt;<em>dog</em>&gt;" {
+		t.Errorf("Expected escaped snippet. Got %q", snippet)
+	}
+
+	if _, ok := q.Snippet("no match here", 10); ok {
+		t.Error("Expected no snippet without a match")
+	}
+}
@@ -0,0 +1,18 @@
+package types
+
+// APIKey is a credential issued to a machine client of the private API
+// only a hash of the secret is kept, the secret itself is shown once on creation
+type APIKey struct {
+	ID      string
+	Name    string
+	Hash    []byte   //SHA-256 of the secret
+	Scopes  []string //permissions granted to the key
+	Created int64    //Unix Epoch Seconds
+	Expires int64    //Unix Epoch Seconds, zero if the key never expires
+	Revoked int64    //Unix Epoch Seconds, zero unless revoked
+}
+
+// Active reports whether the key may be used at the given time
+func (k *APIKey) Active(now int64) bool {
+	return k.Revoked == 0 && (k.Expires == 0 || now < k.Expires)
+}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records a call to a private route. A call which changes messages
+// is recorded once per message changed, with its value before and after.
+// Any other call is recorded once, with the status of its response
+type AuditEntry struct {
+	Seq       uint64 //assigned when the entry is stored, in order
+	Time      int64  //Unix Epoch Nanoseconds
+	Principal string
+	Method    string
+	Route     string //path template of the route called
+	MessageID string
+	Old       *Message //nil unless a message was changed or removed
+	New       *Message //nil unless a message was created or changed
+	Status    int      //zero for entries recording a change
+	ClientIP  string
+	RequestID string
+}
+
+// Custom marshaller for AuditEntry, converts unix nanoseconds to RFC3339 format in UTC
+func (e *AuditEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Seq       uint64   `json:"seq"`
+		Time      string   `json:"time"`
+		Principal string   `json:"principal"`
+		Method    string   `json:"method"`
+		Route     string   `json:"route"`
+		MessageID string   `json:"message_id,omitempty"`
+		Old       *Message `json:"old,omitempty"`
+		New       *Message `json:"new,omitempty"`
+		Status    int      `json:"status,omitempty"`
+		ClientIP  string   `json:"client_ip"`
+		RequestID string   `json:"request_id"`
+	}{
+		Seq:       e.Seq,
+		Time:      time.Unix(0, e.Time).UTC().Format(time.RFC3339Nano),
+		Principal: e.Principal,
+		Method:    e.Method,
+		Route:     e.Route,
+		MessageID: e.MessageID,
+		Old:       e.Old,
+		New:       e.New,
+		Status:    e.Status,
+		ClientIP:  e.ClientIP,
+		RequestID: e.RequestID,
+	})
+}
@@ -0,0 +1,19 @@
+package types
+
+const (
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// Review is a public message held for moderation, and the decision an admin
+// made on it. Decided reviews are kept, as the labelled messages spam filters
+// are trained on
+type Review struct {
+	ID        string //of the message
+	Message   *Message
+	Reasons   []string //why the message was held
+	Held      int64    //Unix Epoch Seconds
+	Decision  string   //empty while pending, then ReviewApproved or ReviewRejected
+	Decided   int64    //Unix Epoch Seconds, zero while pending
+	DecidedBy string
+}
@@ -0,0 +1,38 @@
+package types
+
+// The statuses a message moves through as it is handled. Every message starts
+// out new
+const (
+	StatusNew      = "new"
+	StatusRead     = "read"
+	StatusReplied  = "replied"
+	StatusArchived = "archived"
+)
+
+// statusTransitions lists the statuses each status may move to
+var statusTransitions = map[string][]string{
+	StatusNew:      {StatusRead, StatusReplied, StatusArchived},
+	StatusRead:     {StatusNew, StatusReplied, StatusArchived},
+	StatusReplied:  {StatusArchived},
+	StatusArchived: {StatusRead},
+}
+
+// ValidStatus reports whether status is one a message may have
+func ValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// CanTransition reports whether a message may move from one status to
+// another. Staying in a status is always allowed
+func CanTransition(from, to string) bool {
+	if from == to {
+		return ValidStatus(to)
+	}
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
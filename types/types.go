@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"strconv"
 	"time"
 )
 
@@ -12,6 +13,14 @@ type Message struct {
 	Text  string `json:"text"`
 	Time  int64  //Unix Epoch Seconds
 	TZ    int    //Seconds East of UTC
+
+	DeletedAt int64 `json:"-"` //Unix Epoch Seconds, zero unless soft-deleted
+
+	Status string `json:"-"` //one of the Status constants, new unless moved on
+
+	Version   int   `json:"-"` //1 when first stored, incremented by every edit
+	CreatedAt int64 `json:"-"` //Unix Epoch Seconds
+	UpdatedAt int64 `json:"-"` //Unix Epoch Seconds
 }
 
 // Custom marshaller for Message, converts unix seconds + offset to RFC3339 format
@@ -20,20 +29,36 @@ func (m *Message) MarshalJSON() ([]byte, error) {
 	utc := time.Unix(m.Time, 0)
 	messageTime := utc.In(messageLocation).Format(time.RFC3339)
 	return json.Marshal(&struct {
-		ID    string `json:"id"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
-		Text  string `json:"text"`
-		Time  string `json:"time"`
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		Text      string `json:"text"`
+		Time      string `json:"time"`
+		Status    string `json:"status,omitempty"`
+		Version   int    `json:"version,omitempty"`
+		CreatedAt string `json:"created_at,omitempty"`
+		UpdatedAt string `json:"updated_at,omitempty"`
 	}{
-		ID:    m.ID,
-		Name:  m.Name,
-		Email: m.Email,
-		Text:  m.Text,
-		Time:  messageTime,
+		ID:        m.ID,
+		Name:      m.Name,
+		Email:     m.Email,
+		Text:      m.Text,
+		Time:      messageTime,
+		Status:    m.Status,
+		Version:   m.Version,
+		CreatedAt: formatMetaTime(m.CreatedAt),
+		UpdatedAt: formatMetaTime(m.UpdatedAt),
 	})
 }
 
+// formatMetaTime formats bookkeeping times in UTC, leaving them out if unset
+func formatMetaTime(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
+
 // Custom unmarshaller for Message converts RFC3339 format to unix seconds + offset
 // Aliases Message so that we can inherit fields without inheriting methods
 //   to avoid looping on UnmarshalJSON
@@ -48,13 +73,29 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
-	messageTime, _ := time.Parse(time.RFC3339, aux.Time)
+	//a missing time is left for the caller to require or fill in
+	if aux.Time == "" {
+		return nil
+	}
+	messageTime, err := time.Parse(time.RFC3339, aux.Time)
+	if err != nil {
+		return &TimeError{Value: aux.Time}
+	}
 	_, timeOffset := messageTime.Zone()
 	m.Time = messageTime.Unix()
 	m.TZ = timeOffset
 	return nil
 }
 
+// TimeError is returned when unmarshalling a message whose time is not RFC3339
+type TimeError struct {
+	Value string
+}
+
+func (e *TimeError) Error() string {
+	return "invalid time " + strconv.Quote(e.Value) + ", expected RFC3339"
+}
+
 //Int64Slice attaches sort interface methods to []int64
 //Allows for sort check at end of TestFetchAntiChrono
 type Int64Slice []int64